@@ -0,0 +1,59 @@
+// Command chatctl is the operation tool of the chat function.
+//
+// Usage:
+//
+//	chatctl migrate <up|down|status>
+//	chatctl purge [-dry-run] [-archive table|file|none] [-dir path] [-batch n]
+//	chatctl run [-dry-run] [-span minutes] [-source id [-chat id]] [-mode live|upcoming] [-authors ids] [-skip-sentiment]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/joho/godotenv"
+	"log"
+	"os"
+)
+
+func main() {
+	// If environment file exists, load it
+	// this is for local development
+	if _, err := os.Stat(".env"); err == nil {
+		if err := godotenv.Load(); err != nil {
+			log.Fatalf("godotenv.Load: %v\n", err)
+		}
+	}
+
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "migrate":
+		err = runMigrate(ctx, args)
+	case "purge":
+		err = runPurge(ctx, args)
+	case "run":
+		err = runWatch(ctx, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v\n", flag.Arg(0), err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  chatctl migrate <up|down|status>\n")
+	fmt.Fprintf(os.Stderr, "  chatctl purge [-dry-run] [-archive table|file|none] [-dir path] [-batch n]\n")
+	fmt.Fprintf(os.Stderr, "  chatctl run [-dry-run] [-span minutes] [-source id [-chat id]] [-mode live|upcoming] [-authors ids] [-skip-sentiment]\n")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/uptrace/bun/migrate"
+
+	"github.com/KasumiMercury/patotta-stone-function-chat/functions"
+	"github.com/KasumiMercury/patotta-stone-function-chat/migrations"
+)
+
+func runMigrate(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("subcommand is required: up, down or status")
+	}
+
+	cfg, err := functions.DBConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	db, err := functions.NewDBClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator := migrate.NewMigrator(db, migrations.Migrations)
+	// Create the tables to track the applied migrations
+	if err := migrator.Init(ctx); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		if err := migrator.Lock(ctx); err != nil {
+			return err
+		}
+		defer migrator.Unlock(ctx)
+
+		group, err := migrator.Migrate(ctx)
+		if err != nil {
+			return err
+		}
+		if group.IsZero() {
+			fmt.Println("there are no new migrations to run (database is up to date)")
+			return nil
+		}
+		fmt.Printf("migrated to %s\n", group)
+	case "down":
+		if err := migrator.Lock(ctx); err != nil {
+			return err
+		}
+		defer migrator.Unlock(ctx)
+
+		group, err := migrator.Rollback(ctx)
+		if err != nil {
+			return err
+		}
+		if group.IsZero() {
+			fmt.Println("there are no groups to roll back")
+			return nil
+		}
+		fmt.Printf("rolled back %s\n", group)
+	case "status":
+		ms, err := migrator.MigrationsWithStatus(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("migrations: %s\n", ms)
+		fmt.Printf("unapplied migrations: %s\n", ms.Unapplied())
+		fmt.Printf("last migration group: %s\n", ms.LastGroup())
+	default:
+		return fmt.Errorf("unknown subcommand: %s", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/KasumiMercury/patotta-stone-function-chat/functions"
+)
+
+func runPurge(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report the expired chats without deleting them")
+	archive := fs.String("archive", "table", "where the expired chats are moved: table, file or none")
+	dir := fs.String("dir", "archive", "directory of the archive files when -archive=file")
+	batch := fs.Int("batch", 500, "number of chats deleted in a transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts := functions.PurgeOptions{
+		DryRun:    *dryRun,
+		BatchSize: *batch,
+	}
+	switch *archive {
+	case "table":
+		opts.Archiver = functions.TableArchiver{}
+	case "file":
+		opts.Archiver = functions.FileArchiver{Dir: *dir}
+	case "none":
+	default:
+		return fmt.Errorf("unknown archive: %s", *archive)
+	}
+
+	policy, err := functions.RetentionPolicyFromEnv()
+	if err != nil {
+		return err
+	}
+	opts.Policy = policy
+
+	cfg, err := functions.DBConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	repo, err := functions.NewChatRepository(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	reports, err := functions.PurgeChats(ctx, repo, opts)
+	// The report is printed even if the purge fails halfway
+	printPurgeReports(reports, *dryRun)
+	return err
+}
+
+func printPurgeReports(reports []functions.PurgeReport, dryRun bool) {
+	if len(reports) == 0 {
+		fmt.Println("there are no chats with a finite retention")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tSTATUS\tRETENTION\tBEFORE\tEXPIRED\tPURGED")
+	total := 0
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%s\t%dd\t%s\t%d\t%d\n", r.SourceID, r.Status, r.RetentionDays, r.Before.Format("2006-01-02T15:04:05Z07:00"), r.Expired, r.Purged)
+		total += r.Expired
+	}
+	w.Flush()
+
+	if dryRun {
+		fmt.Printf("dry run: %d chats would be purged\n", total)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/KasumiMercury/patotta-stone-function-chat/functions"
+)
+
+func runWatch(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "fetch and analyze the chats without saving nor delivering them")
+	span := fs.Int("span", 60, "minutes before now from which the chats are fetched")
+	sourceID := fs.String("source", "", "source ID of the video processed instead of the videos looked up by the status")
+	chatID := fs.String("chat", "", "chat ID of the video of -source (default: the chat ID in the database)")
+	mode := fs.String("mode", "", "force the handling of the videos: live or upcoming")
+	authors := fs.String("authors", "", "comma-separated channel IDs replacing TARGET_CHANNEL_ID")
+	skipSentiment := fs.Bool("skip-sentiment", false, "preview the chats as non-negative without the sentiment analysis (requires -dry-run)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	options := functions.RunOptions{
+		Span:          *span,
+		DryRun:        *dryRun,
+		Mode:          *mode,
+		SkipSentiment: *skipSentiment,
+	}
+	if *sourceID != "" {
+		options.Target = &functions.VideoInfo{SourceID: *sourceID, ChatID: *chatID}
+	}
+	if *authors != "" {
+		options.Authors = strings.Split(*authors, ",")
+	}
+
+	run, err := functions.RunChatWatcher(ctx, options)
+	if run == nil {
+		return err
+	}
+
+	// The response is printed even if the run fails
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(run.Response(err)); err != nil {
+		return err
+	}
+	if run.StatusCode(err) == http.StatusInternalServerError {
+		if err == nil {
+			err = fmt.Errorf("all videos failed")
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/joho/godotenv"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/KasumiMercury/patotta-stone-function-chat/functions"
+)
+
+func main() {
+	// If environment file exists, load it
+	// this is for local development
+	if _, err := os.Stat(".env"); err == nil {
+		if err := godotenv.Load(); err != nil {
+			log.Fatalf("godotenv.Load: %v\n", err)
+		}
+	}
+
+	// Stop the watcher on SIGTERM (sent by Cloud Run or Kubernetes) or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	slog.SetDefault(functions.NewCustomLogger(ctx))
+
+	ytApiKey := os.Getenv("YOUTUBE_API_KEY")
+	if ytApiKey == "" {
+		log.Fatalf("YOUTUBE_API_KEY is not set\n")
+	}
+	dbConfig, err := functions.DBConfigFromEnv()
+	if err != nil {
+		log.Fatalf("functions.DBConfigFromEnv: %v\n", err)
+	}
+	targetChannelIdStr := os.Getenv("TARGET_CHANNEL_ID")
+	if targetChannelIdStr == "" {
+		log.Fatalf("TARGET_CHANNEL_ID is not set\n")
+	}
+	targetChannels := strings.Split(targetChannelIdStr, ",")
+
+	source, err := functions.NewChatSource(ctx, ytApiKey)
+	if err != nil {
+		log.Fatalf("functions.NewChatSource: %v\n", err)
+	}
+	if closer, ok := source.(io.Closer); ok {
+		defer closer.Close()
+	}
+	repo, err := functions.NewChatRepository(ctx, dbConfig)
+	if err != nil {
+		log.Fatalf("functions.NewChatRepository: %v\n", err)
+	}
+	defer repo.Close()
+
+	watcher := functions.NewWatcher(source, repo, targetChannels)
+	// The chats are queued in the outbox and delivered only if a sink is configured
+	dispatcher, err := functions.OutboxDispatcherFromEnv(repo)
+	if err != nil {
+		log.Fatalf("functions.OutboxDispatcherFromEnv: %v\n", err)
+	}
+	watcher.Dispatcher = dispatcher
+	// The broker is shared with the pipeline of liveChatWatcher in the same process
+	broker := functions.DefaultBroker()
+	watcher.Broker = broker
+	hub := functions.NewHub(broker)
+	if origins := os.Getenv("HUB_ALLOWED_ORIGINS"); origins != "" {
+		hub.AllowedOrigins = strings.Split(origins, ",")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", watcher.HealthHandler())
+	mux.Handle("/events", functions.SSEHandler(broker, repo))
+	mux.Handle("/ws", hub.Handler())
+
+	// Use PORT environment variable, or default to 8080.
+	port := "8080"
+	if envPort := os.Getenv("PORT"); envPort != "" {
+		port = envPort
+	}
+	// By default, listen on all interfaces. If testing locally, run with
+	// LOCAL_ONLY=true to avoid exposing the server outside your own machine.
+	hostname := ""
+	if localOnly := os.Getenv("LOCAL_ONLY"); localOnly == "true" {
+		hostname = "127.0.0.1"
+	}
+	srv := &http.Server{
+		Addr:    hostname + ":" + port,
+		Handler: mux,
+		// The streams of the events are closed on shutdown
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("http.ListenAndServe: %v\n", err)
+		}
+	}()
+
+	if err := watcher.Run(ctx); err != nil {
+		slog.Error("Failed to flush pending chats on shutdown", "error", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shutdown server", "error", err)
+	}
+}
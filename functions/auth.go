@@ -0,0 +1,36 @@
+package functions
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// authorizeOverrides authenticates the operator by the bearer token in ADMIN_TOKENS ("token1,token2" for the rotation)
+// before the overrides of chatWatcher and the run records.
+// It returns the status of the rejection: 401 without a valid token, and 403 if no token is configured.
+func authorizeOverrides(r *http.Request) (int, error) {
+	value := os.Getenv("ADMIN_TOKENS")
+	if value == "" {
+		return http.StatusForbidden, errors.New("admin tokens are not configured")
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return http.StatusUnauthorized, errors.New("missing bearer token")
+	}
+	// Every token is compared so that the time does not tell which token matched
+	matched := 0
+	for _, t := range strings.Split(value, ",") {
+		if t != "" {
+			matched |= subtle.ConstantTimeCompare([]byte(t), []byte(token))
+		}
+	}
+	if matched != 1 {
+		return http.StatusUnauthorized, errors.New("invalid bearer token")
+	}
+
+	return http.StatusOK, nil
+}
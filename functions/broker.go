@@ -0,0 +1,158 @@
+package functions
+
+import (
+	"slices"
+	"sync"
+)
+
+const (
+	// AuthorClassTarget is the class of the chats by the target channels, which are saved to the database
+	AuthorClassTarget = "target"
+	// AuthorClassOther is the class of the other chats, which are only forwarded
+	AuthorClassOther = "other"
+)
+
+// ChatEvent is a chat delivered by Broker
+type ChatEvent struct {
+	ChatRecord
+	AuthorClass string `json:"authorClass"`
+}
+
+// ChatFilter selects the events delivered to a subscription. The zero values match all the events.
+type ChatFilter struct {
+	SourceIDs   []string
+	AuthorClass string
+}
+
+func (f ChatFilter) Match(event ChatEvent) bool {
+	if len(f.SourceIDs) != 0 && !slices.Contains(f.SourceIDs, event.SourceID) {
+		return false
+	}
+	if f.AuthorClass != "" && f.AuthorClass != event.AuthorClass {
+		return false
+	}
+	return true
+}
+
+// defaultBroker is shared by the pipelines and the subscribers in the same process
+var defaultBroker = NewBroker()
+
+// DefaultBroker returns the process-wide broker that liveChatWatcher publishes to
+func DefaultBroker() *Broker {
+	return defaultBroker
+}
+
+// Broker is the in-process pub/sub of the chats handled by the pipeline.
+// Publish never blocks: a subscription whose buffer is full is dropped,
+// and the subscriber is supposed to resume from the database.
+type Broker struct {
+	// BufferSize is the number of the events buffered for each subscription
+	BufferSize int
+
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		BufferSize: 256,
+		subs:       make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives the events matching its filter from C until it is closed
+type Subscription struct {
+	// C is closed when the subscription is closed or dropped
+	C <-chan ChatEvent
+
+	broker  *Broker
+	ch      chan ChatEvent
+	filter  ChatFilter
+	dropped bool
+}
+
+func (b *Broker) Subscribe(filter ChatFilter) *Subscription {
+	// The filter is copied so that the caller can reuse it
+	filter.SourceIDs = slices.Clone(filter.SourceIDs)
+	ch := make(chan ChatEvent, b.BufferSize)
+	sub := &Subscription{
+		C:      ch,
+		broker: b,
+		ch:     ch,
+		filter: filter,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[sub] = struct{}{}
+
+	return sub
+}
+
+// Publish delivers the events to the subscriptions matching them
+func (b *Broker) Publish(events ...ChatEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		for _, event := range events {
+			if !sub.filter.Match(event) {
+				continue
+			}
+			select {
+			case sub.ch <- event:
+			default:
+				// The subscriber cannot keep up with the pipeline
+				sub.dropped = true
+				b.remove(sub)
+			}
+			if sub.dropped {
+				break
+			}
+		}
+	}
+}
+
+// remove must be called with b.mu held
+func (b *Broker) remove(sub *Subscription) {
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+	close(sub.ch)
+}
+
+// Close stops the subscription. It is safe to call Close more than once.
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.remove(s)
+}
+
+// SetFilter changes the events delivered to the subscription from the next Publish
+func (s *Subscription) SetFilter(filter ChatFilter) {
+	filter.SourceIDs = slices.Clone(filter.SourceIDs)
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.filter = filter
+}
+
+// Dropped reports whether the subscription was closed because its buffer was full
+func (s *Subscription) Dropped() bool {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	return s.dropped
+}
+
+// newChatEvents converts the records to the events of the author class
+func newChatEvents(class string, records []ChatRecord) []ChatEvent {
+	events := make([]ChatEvent, 0, len(records))
+	for _, record := range records {
+		events = append(events, ChatEvent{ChatRecord: record, AuthorClass: class})
+	}
+	return events
+}
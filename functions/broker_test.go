@@ -0,0 +1,92 @@
+package functions
+
+import (
+	"slices"
+	"testing"
+)
+
+// receiveIDs reads the buffered events of the subscription, and reports whether it is closed
+func receiveIDs(sub *Subscription) (ids []string, closed bool) {
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return ids, true
+			}
+			ids = append(ids, event.ID)
+		default:
+			return ids, false
+		}
+	}
+}
+
+// testEvent is the event of the chat with the ID as its message
+func testEvent(id, sourceID, class string) ChatEvent {
+	return ChatEvent{ChatRecord: ChatRecord{ID: id, Message: id, SourceID: sourceID}, AuthorClass: class}
+}
+
+func TestBrokerPublishFanOut(t *testing.T) {
+	broker := NewBroker()
+	all := broker.Subscribe(ChatFilter{})
+	filter := ChatFilter{SourceIDs: []string{"a"}}
+	videoA := broker.Subscribe(filter)
+	// The filter is copied, so changing it later does not change the subscription
+	filter.SourceIDs[0] = "b"
+	targetB := broker.Subscribe(ChatFilter{SourceIDs: []string{"b"}, AuthorClass: AuthorClassTarget})
+
+	broker.Publish(
+		testEvent("a1", "a", AuthorClassTarget),
+		testEvent("b1", "b", AuthorClassOther),
+		testEvent("b2", "b", AuthorClassTarget),
+	)
+
+	tests := []struct {
+		name string
+		sub  *Subscription
+		want []string
+	}{
+		{name: "all", sub: all, want: []string{"a1", "b1", "b2"}},
+		{name: "source", sub: videoA, want: []string{"a1"}},
+		{name: "source and author", sub: targetB, want: []string{"b2"}},
+	}
+	for _, tt := range tests {
+		got, closed := receiveIDs(tt.sub)
+		if closed || !slices.Equal(got, tt.want) {
+			t.Errorf("%s: events = %v (closed %v), want %v", tt.name, got, closed, tt.want)
+		}
+	}
+
+	// The new filter applies from the next Publish, and a closed subscription receives nothing
+	videoA.SetFilter(ChatFilter{SourceIDs: []string{"b"}})
+	targetB.Close()
+	targetB.Close()
+	broker.Publish(testEvent("a2", "a", AuthorClassTarget), testEvent("b3", "b", AuthorClassTarget))
+	if got, _ := receiveIDs(videoA); !slices.Equal(got, []string{"b3"}) {
+		t.Errorf("events after SetFilter = %v, want [b3]", got)
+	}
+	if got, closed := receiveIDs(targetB); len(got) != 0 || !closed || targetB.Dropped() {
+		t.Errorf("closed subscription: events = %v, closed = %v, dropped = %v", got, closed, targetB.Dropped())
+	}
+}
+
+func TestBrokerDropsSlowSubscriber(t *testing.T) {
+	broker := NewBroker()
+	broker.BufferSize = 2
+	slow := broker.Subscribe(ChatFilter{SourceIDs: []string{"a"}})
+	other := broker.Subscribe(ChatFilter{SourceIDs: []string{"b"}})
+
+	broker.Publish(testEvent("a1", "a", ""), testEvent("a2", "a", ""), testEvent("a3", "a", ""), testEvent("b1", "b", ""))
+
+	// The buffered events are still received before the channel is closed
+	if got, closed := receiveIDs(slow); !slices.Equal(got, []string{"a1", "a2"}) || !closed {
+		t.Errorf("slow: events = %v, closed = %v, want [a1 a2] and closed", got, closed)
+	}
+	if !slow.Dropped() {
+		t.Error("slow subscription is not dropped")
+	}
+	// Dropping a subscription does not affect the others
+	if got, closed := receiveIDs(other); !slices.Equal(got, []string{"b1"}) || closed || other.Dropped() {
+		t.Errorf("other: events = %v, closed = %v", got, closed)
+	}
+	slow.Close()
+}
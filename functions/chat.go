@@ -8,16 +8,13 @@ import (
 	"github.com/Code-Hex/synchro"
 	"github.com/Code-Hex/synchro/tz"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
-	"github.com/uptrace/bun"
-	"github.com/vmihailenco/msgpack/v5"
 	"golang.org/x/text/unicode/norm"
-	"google.golang.org/api/option"
 	"google.golang.org/api/youtube/v3"
 	"log/slog"
 	"net/http"
 	"os"
 	"regexp"
-	"sort"
+	"slices"
 	"strings"
 	"time"
 )
@@ -34,6 +31,9 @@ func init() {
 	}
 	handler := InstrumentedHandler("chat", chatWatcher, tp)
 	functions.HTTP("chat", handler)
+	functions.HTTP("runs", InstrumentedHandler("runs", runsHandler, tp))
+	functions.HTTP("chats", InstrumentedHandler("chats", chatsHandler, tp))
+	functions.CloudEvent("chatEvent", InstrumentedEventHandler("chatEvent", chatEvent, tp))
 }
 
 func chatWatcher(w http.ResponseWriter, r *http.Request) {
@@ -43,6 +43,49 @@ func chatWatcher(w http.ResponseWriter, r *http.Request) {
 	logger := NewCustomLogger(ctx)
 	slog.SetDefault(logger)
 
+	cfg := loadWatchConfig()
+
+	// Initialize span and the other options
+	options, err := getRunOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Only the authenticated callers may override the configuration
+	if options.HasOverrides() {
+		if status, err := authorizeOverrides(r); err != nil {
+			slog.Warn("Rejected overrides",
+				slog.Group("chatWatcher", "status", status, "error", err),
+			)
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	run, err := runChatWatcher(ctx, cfg, options)
+	if run == nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The response describes the run even if it failed
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(run.StatusCode(err))
+	if err := json.NewEncoder(w).Encode(run.Response(err)); err != nil {
+		slog.Error("Failed to write run response", "error", err)
+	}
+	slog.Info("chatWatcher")
+}
+
+// watchConfig is the configuration of chatWatcher read from the environment variables
+type watchConfig struct {
+	ytApiKey       string
+	targetChannels []string
+	staticTarget   VideoInfo
+}
+
+// loadWatchConfig reads the environment variables common to the entry points
+func loadWatchConfig() watchConfig {
 	// Cache common environment variables
 	// Because the function is supposed to run on CloudFunctions, it is necessary to read the environment variables here.
 	// If the environment variable is not set, the function will panic.
@@ -53,8 +96,7 @@ func chatWatcher(w http.ResponseWriter, r *http.Request) {
 		panic("YOUTUBE_API_KEY is not set")
 	}
 
-	dsn := os.Getenv("DSN")
-	if dsn == "" {
+	if os.Getenv("DSN") == "" {
 		slog.Error("DSN is not set")
 		panic("DSN is not set")
 	}
@@ -67,49 +109,189 @@ func chatWatcher(w http.ResponseWriter, r *http.Request) {
 	// Split targetChannelIdStr by comma
 	targetChannels := strings.Split(targetChannelIdStr, ",")
 
-	// Initialize span
-	span, err := getSpanQuery(r.URL)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	// load info of video from environment variables
+	staticEnv := os.Getenv("STATIC_TARGET")
+	var staticTarget VideoInfo
+	if err := json.Unmarshal([]byte(staticEnv), &staticTarget); err != nil {
+		slog.Error("Failed to unmarshal static target",
+			"error", err,
+		)
+		panic(fmt.Sprintf("Failed to unmarshal static target: %v", err))
+	}
+
+	return watchConfig{
+		ytApiKey:       ytApiKey,
+		targetChannels: targetChannels,
+		staticTarget:   staticTarget,
 	}
-	// Initialize threshold time for filtering chats
-	threshold := time.Now().Add(-time.Duration(span) * time.Minute).Unix()
+}
 
-	// Create YouTube service
-	ytSvc, err := youtube.NewService(ctx, option.WithAPIKey(ytApiKey))
+// RunOptions is the options of an invocation given by the HTTP query or the Pub/Sub message
+type RunOptions struct {
+	// Span is the minutes before now from which the chats are fetched
+	Span int `json:"span"`
+	// Target replaces the videos looked up by the status, ignoring the polling interval
+	Target *VideoInfo `json:"target,omitempty"`
+	// Mode forces the handling of the videos as RunModeLive or RunModeUpcoming.
+	// Without Target, only the videos of the status are processed.
+	// With Target, the status of the target decides the handling if Mode is empty.
+	Mode string `json:"mode,omitempty"`
+	// DryRun fetches and analyzes the chats without writing them nor delivering them
+	DryRun bool `json:"dryRun,omitempty"`
+	// Authors replaces the target channels of TARGET_CHANNEL_ID
+	Authors []string `json:"authors,omitempty"`
+	// SkipSentiment previews the chats outside the lives as non-negative without Natural Language API.
+	// It requires DryRun, because the chats saved without the analysis could not be told from the non-negative chats.
+	SkipSentiment bool `json:"skipSentiment,omitempty"`
+}
+
+// maxOverrideAuthors is the maximum number of the authors in RunOptions
+const maxOverrideAuthors = 50
+
+func (o RunOptions) validate() error {
+	if o.Span < 0 || o.Span > 10080 {
+		return fmt.Errorf("span out of range: %d", o.Span)
+	}
+	if o.Target != nil {
+		if o.Target.SourceID == "" {
+			return fmt.Errorf("target has no sourceId")
+		}
+		if len(o.Target.SourceID) > 255 || len(o.Target.ChatID) > 255 {
+			return fmt.Errorf("target ID too long")
+		}
+	}
+	if o.Mode != "" && o.Mode != RunModeLive && o.Mode != RunModeUpcoming {
+		return fmt.Errorf("unknown mode: %q", o.Mode)
+	}
+	if len(o.Authors) > maxOverrideAuthors {
+		return fmt.Errorf("too many authors: %d exceeds maximum of %d", len(o.Authors), maxOverrideAuthors)
+	}
+	for _, author := range o.Authors {
+		if author == "" || len(author) > 255 {
+			return fmt.Errorf("invalid author: %q", author)
+		}
+	}
+	if o.SkipSentiment && !o.DryRun {
+		return fmt.Errorf("skipSentiment requires dryRun")
+	}
+	return nil
+}
+
+// HasOverrides reports whether the options override the configuration or make a dry run,
+// which only the authenticated callers may do
+func (o RunOptions) HasOverrides() bool {
+	return o.Target != nil || o.Mode != "" || len(o.Authors) != 0 || o.SkipSentiment || o.DryRun
+}
+
+// RunChatWatcher runs the pipeline once with the configuration of the environment variables, e.g. from a command.
+// It returns nil run if the run could not start.
+func RunChatWatcher(ctx context.Context, options RunOptions) (*Run, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return runChatWatcher(ctx, loadWatchConfig(), options)
+}
+
+// runChatWatcher is the pipeline shared by the entry points.
+// It returns nil run if the run could not start.
+func runChatWatcher(ctx context.Context, cfg watchConfig, options RunOptions) (*Run, error) {
+	// Get the source of chats (YouTube API by default)
+	// The clients are created on the first request and reused by the following requests on the same instance
+	source, err := getChatSource(ctx, cfg.ytApiKey)
 	if err != nil {
-		slog.Error("Failed to create YouTube service",
+		slog.Error("Failed to create chat source",
 			slog.Group("YouTubeAPI", "error", err),
 		)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	// Create Database Client
-	dbClient, err := NewDBClient(dsn)
+	// Get Database Client
+	repo, err := getChatRepository(ctx)
 	if err != nil {
 		slog.Error("Failed to create Database client",
 			slog.Group("database", "error", err),
 		)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+
+	opts := watchOptions{
+		// Initialize threshold time for filtering chats
+		threshold:      time.Now().Add(-time.Duration(options.Span) * time.Minute).Unix(),
+		targetChannels: cfg.targetChannels,
+		staticTarget:   cfg.staticTarget,
+		pollInterval:   getPollIntervalEnv(),
+		lockTTL:        getLockTTLEnv(),
+		lockWait:       getLockWaitEnv(),
+		target:         options.Target,
+		mode:           options.Mode,
+		skipSentiment:  options.SkipSentiment,
 	}
+	if len(options.Authors) != 0 {
+		opts.targetChannels = options.Authors
+	}
+
+	// The statistics of the run are recorded even if the run fails
+	run := NewRun(options.Span)
+	run.DryRun = options.DryRun
+	defer run.Unlock(ctx, repo)
+	err = watchChats(ctx, source, repo, opts, run)
+	run.Finish(ctx, repo, err)
+
+	return run, err
+}
 
+// watchOptions is the settings of a run of watchChats
+type watchOptions struct {
+	// threshold is the unix time before which the chats are ignored
+	threshold      int64
+	targetChannels []string
+	staticTarget   VideoInfo
+	// pollInterval is the maximum interval between the polls of an upcoming video
+	pollInterval time.Duration
+	// lockTTL and lockWait configure the lease of each video taken by the run
+	lockTTL  time.Duration
+	lockWait time.Duration
+	// target, mode and skipSentiment are given by RunOptions
+	target        *VideoInfo
+	mode          string
+	skipSentiment bool
+}
+
+// watchChats fetches the chats of the live or upcoming videos and saves the chats of the targets
+func watchChats(ctx context.Context, source ChatSource, repo ChatRepository, opts watchOptions, run *Run) error {
 	// Get info of videos with the target status
 	targetStatus := []string{"live", "upcoming"}
-	videoRecords, err := getVideoRecordByStatus(ctx, dbClient, targetStatus)
+	videoRecords, err := repo.GetVideoRecordByStatus(ctx, targetStatus)
 	if err != nil {
 		slog.Error("Failed to get video records",
 			slog.Group("database", "error", err),
 		)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
+	}
+
+	// Get the poll state of the videos to skip the chats that are closed or polled too early
+	var polls map[string]PollRecord
+	if len(videoRecords) > 0 {
+		ids := make([]string, len(videoRecords))
+		for i, video := range videoRecords {
+			ids[i] = video.SourceID
+		}
+		polls, err = repo.GetPollRecordEachSource(ctx, ids)
+		if err != nil {
+			slog.Error("Failed to get poll records",
+				slog.Group("database", "error", err),
+			)
+			return err
+		}
 	}
 
 	// Separate processing by status: live or upcoming
 	var liveVideos []VideoInfo
 	var upcomingVideos []VideoInfo
 	for _, video := range videoRecords {
+		// The chat that went offline is no longer requested and no longer counted as live
+		if !polls[video.SourceID].OfflineAt.IsZero() {
+			continue
+		}
 		if video.Status == "live" {
 			liveVideos = append(liveVideos, VideoInfo{
 				ChatID:   video.ChatID,
@@ -117,16 +299,34 @@ func chatWatcher(w http.ResponseWriter, r *http.Request) {
 			})
 		} else {
 			upcomingVideos = append(upcomingVideos, VideoInfo{
-				ChatID:   video.ChatID,
-				SourceID: video.SourceID,
+				ChatID:      video.ChatID,
+				SourceID:    video.SourceID,
+				ScheduledAt: video.ScheduledAt,
 			})
 		}
 	}
 
+	// The options narrow the videos to process
+	forced := opts.target != nil
+	if forced {
+		liveVideos, upcomingVideos, err = forceTarget(ctx, repo, *opts.target, opts.mode)
+		if err != nil {
+			return err
+		}
+	} else {
+		switch opts.mode {
+		case RunModeLive:
+			upcomingVideos = nil
+		case RunModeUpcoming:
+			liveVideos = nil
+		}
+	}
+
 	// If there is a live video, process only that video and skip processing of other videos.
 	// Because the chat of the target of acquisition is focused on the live video,
 	// and chatting to other videos during the live is not necessary for the use case.
 	if len(liveVideos) > 0 {
+		run.Record.Mode = RunModeLive
 		if len(liveVideos) > 1 {
 			ids := make([]string, len(liveVideos))
 			for i, video := range liveVideos {
@@ -140,172 +340,261 @@ func chatWatcher(w http.ResponseWriter, r *http.Request) {
 			"Live video found",
 			slog.Group("liveVideo", "chatId", liveVideos[0].ChatID),
 		)
-		if err := liveChatWatcher(ctx, ytSvc, dbClient, liveVideos[0], threshold, targetChannels); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		// Skip the poll if the polling interval requested by the API has not elapsed yet
+		if !forced && !isPollDue(polls[liveVideos[0].SourceID], time.Now()) {
+			slog.Info(
+				"Skip polling live video before the polling interval",
+				slog.Group("liveVideo", "chatId", liveVideos[0].ChatID, "nextPollAt", polls[liveVideos[0].SourceID].NextPollAt),
+			)
+			return nil
+		}
+		// Skip the video processed by an overlapping invocation
+		if ok, err := run.Lock(ctx, repo, liveVideos[0].SourceID, opts.lockTTL, opts.lockWait); err != nil || !ok {
+			return err
 		}
 
 		// Other videos are skipped
-		w.WriteHeader(http.StatusOK)
-		return
+		return liveChatWatcher(ctx, source, repo, liveVideos[0], opts.threshold, opts.targetChannels, run)
 	}
 
-	// load info of video from environment variables
-	staticEnv := os.Getenv("STATIC_TARGET")
-	var staticTarget VideoInfo
-	if err := json.Unmarshal([]byte(staticEnv), &staticTarget); err != nil {
-		slog.Error("Failed to unmarshal static target",
-			"error", err,
-		)
-		panic(fmt.Sprintf("Failed to unmarshal static target: %v", err))
+	// Nothing is processed in the live mode without live videos
+	if opts.mode == RunModeLive {
+		run.Record.Mode = RunModeLive
+		slog.Info("No live video found")
+		return nil
 	}
+
+	run.Record.Mode = RunModeStatic
 	var allChats []Chat
 
 	// Fetch chats from static target video
-	staticChats, err := fetchStaticTarget(ctx, dbClient, ytSvc, staticTarget, threshold, targetChannels)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// The static target is skipped while an overlapping invocation processes it,
+	// and when the options narrow the videos.
+	staticTarget := opts.staticTarget
+	locked := false
+	if !forced && opts.mode == "" {
+		locked, err = run.Lock(ctx, repo, staticTarget.SourceID, opts.lockTTL, opts.lockWait)
+		if err != nil {
+			return err
+		}
 	}
-	slog.Info(
-		"Fetched chats from upcoming video",
-		slog.Group("fetchChat", "chatId", staticTarget.ChatID, slog.Group("static", "sourceId", staticTarget.SourceID, "count", len(staticChats))),
-	)
-	allChats = append(allChats, staticChats...)
+	if locked {
+		// The failure of the static target does not stop the upcoming videos
+		staticChats, err := fetchStaticTarget(ctx, repo, source, staticTarget, opts.threshold, opts.targetChannels, run)
+		if err != nil {
+			run.Fail(staticTarget.SourceID, "fetch", err)
+		} else {
+			slog.Info(
+				"Fetched chats from upcoming video",
+				slog.Group("fetchChat", "chatId", staticTarget.ChatID, slog.Group("static", "sourceId", staticTarget.SourceID, "count", len(staticChats))),
+			)
+			allChats = append(allChats, staticChats...)
+		}
+	}
+
+	// Exclude the upcoming videos that must not be polled yet
+	upcomingVideos = slices.DeleteFunc(upcomingVideos, func(video VideoInfo) bool {
+		return !forced && !isPollDue(polls[video.SourceID], time.Now())
+	})
 
 	if len(upcomingVideos) != 0 {
+		run.Record.Mode = RunModeUpcoming
 		// If upcoming videos are more than 1, find the priority target
 		// to reduce the number of API requests and prevent overuse of quota of YouTube API
-		upcomingTarget, lastPublished, err := findPriorityTarget(ctx, dbClient, upcomingVideos)
+		upcomingTarget, err := findPriorityTarget(upcomingVideos, polls, opts.pollInterval)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
-		// Fetch chats from upcoming videos
-		upcomingChats, err := fetchChatsByChatID(ctx, ytSvc, upcomingTarget, 0)
+		// Skip the target processed by an overlapping invocation
+		locked, err := run.Lock(ctx, repo, upcomingTarget.SourceID, opts.lockTTL, opts.lockWait)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
-		slog.Info(
-			"Fetched chats from upcoming video",
-			slog.Group("fetchChat", "chatId", upcomingTarget.ChatID, slog.Group("upcoming", "sourceId", upcomingTarget.SourceID, "count", len(upcomingChats))),
-		)
-		// Filter the chats by the threshold if the lastPublished is not 0
-		// If the lastPublished is 0, the chats are not filtered and all chats are appended to the allChats
-		if lastPublished != 0 {
-			upcomingChats = filterChatsByPublishedAt(upcomingChats, lastPublished)
+		if locked {
+			upcomingChats, err := fetchUpcomingTarget(ctx, repo, source, upcomingTarget, opts.targetChannels, run)
+			if err != nil {
+				run.Fail(upcomingTarget.SourceID, "fetch", err)
+			}
+			// Append the chats to the allChats
+			allChats = append(allChats, upcomingChats...)
 		}
-		// Filter the chats by the target channels
-		upcomingChats, _ = separateChatsByAuthor(upcomingChats, targetChannels)
-		// Append the chats to the allChats
-		allChats = append(allChats, upcomingChats...)
 	}
 
-	// If the length of the staticChats is 0, return
+	// If the length of the allChats is 0, commit only the poll states and deliver the batches left by the previous runs
 	if len(allChats) == 0 {
 		slog.Info("No chats found")
-		w.WriteHeader(http.StatusOK)
-		return
+		if _, err := run.Commit(ctx, repo); err != nil {
+			return err
+		}
+		dispatcher, err := OutboxDispatcherFromEnv(repo)
+		if err != nil {
+			return err
+		}
+		return dispatchToSinks(ctx, dispatcher, run)
 	}
 
 	// Convert the chats to the chat records
 	chatRecords := convertChatsToRecords(allChats)
 
-	// Create Natural Language API client for sentiment analysis
-	nlClient, err := NewAnalysisClient(ctx)
+	if opts.skipSentiment {
+		// Only the dry run skips the analysis, so the chats are never saved as non-negative without it
+		slog.Info("Skip sentiment analysis", slog.Group("saveChat", "count", len(chatRecords)))
+	} else {
+		// Get Natural Language API client for sentiment analysis
+		nlClient, err := getAnalysisClient(ctx)
+		if err != nil {
+			slog.Error("Failed to create Natural Language API client",
+				slog.Group("saveChat", slog.Group("NaturalLanguageAPI", "error", err)),
+			)
+			return err
+		}
+
+		// Validate the negativity sentiment of the chats
+		// Negative flags are used in other linked services
+		chatRecords, err = validateNegativitySentiment(ctx, nlClient, chatRecords, run)
+		if err != nil {
+			slog.Error("Failed to analyze sentiment",
+				slog.Group("saveChat", slog.Group("NaturalLanguageAPI", "error", err)),
+			)
+			return err
+		}
+	}
+
+	// Insert the chats to the database along with the poll states and the batches to the sinks in a single transaction
+	run.AddChats(chatRecords)
+	dispatcher, err := routeToSinks(ctx, repo, run, newChatEvents(AuthorClassTarget, chatRecords))
 	if err != nil {
-		slog.Error("Failed to create Natural Language API client",
-			slog.Group("saveChat", slog.Group("NaturalLanguageAPI", "error", err)),
-		)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
+	}
+	if _, err := run.Commit(ctx, repo); err != nil {
+		return err
 	}
 
-	// Validate the negativity sentiment of the chats
-	// Negative flags are used in other linked services
-	chatRecords, err = validateNegativitySentiment(ctx, nlClient, chatRecords)
+	return dispatchToSinks(ctx, dispatcher, run)
+}
 
-	// Insert the chats to the database
-	if err := InsertChatRecord(ctx, dbClient, chatRecords); err != nil {
-		slog.Error("Failed to insert chat records",
-			slog.Group("saveChat", slog.Group("database", "error", err)),
+// forceTarget returns the target as the live or upcoming video by the mode, or by its status if the mode is empty.
+// The chat ID and the scheduled time missing in the target are filled from the video record.
+func forceTarget(ctx context.Context, repo ChatRepository, target VideoInfo, mode string) ([]VideoInfo, []VideoInfo, error) {
+	records, err := repo.GetVideoRecordEachSource(ctx, []string{target.SourceID})
+	if err != nil {
+		slog.Error("Failed to get video record",
+			slog.Group("database", "sourceId", target.SourceID, "error", err),
 		)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, nil, err
+	}
+	record, ok := records[target.SourceID]
+	if ok {
+		if target.ChatID == "" {
+			target.ChatID = record.ChatID
+		}
+		target.ScheduledAt = record.ScheduledAt
+	}
+	if target.ChatID == "" {
+		return nil, nil, fmt.Errorf("no chat ID of target video: %s", target.SourceID)
 	}
 
-	w.WriteHeader(http.StatusOK)
-	slog.Info("chatWatcher")
+	if mode == "" {
+		mode = RunModeUpcoming
+		if record.Status == "live" {
+			mode = RunModeLive
+		}
+	}
+	slog.Info("Force target video",
+		slog.Group("forceTarget", "sourceId", target.SourceID, "chatId", target.ChatID, "mode", mode),
+	)
+	if mode == RunModeLive {
+		return []VideoInfo{target}, nil, nil
+	}
+	return nil, []VideoInfo{target}, nil
 }
 
-func liveChatWatcher(ctx context.Context, ytSvc *youtube.Service, dbClient *bun.DB, video VideoInfo, threshold int64, target []string) error {
+func liveChatWatcher(ctx context.Context, source ChatSource, repo ChatRepository, video VideoInfo, threshold int64, target []string, run *Run) error {
 	// Fetch chats by YouTube API
-	chats, err := fetchChatsByChatID(ctx, ytSvc, video, 0)
+	run.Touch(video.SourceID)
+	chats, cursor, err := source.FetchChats(ctx, video, "")
+	run.CountFetch(len(chats))
 	if err != nil {
 		slog.Error("Failed to fetch chats from YouTube API",
 			slog.Group("fetchChat", "chatId", video.ChatID, "error", err),
 		)
+		run.Fail(video.SourceID, "fetch", err)
 		return err
 	}
+	// Record the poll to honor the polling interval and the offline time in the next runs
+	run.AddPoll(video, cursor, time.Now())
 
 	// Filter the chats by the threshold
+	fetched := len(chats)
 	chats = filterChatsByPublishedAt(chats, threshold)
+	run.CountFiltered(fetched - len(chats))
 	// Separate the chats by the author channel ID
 	targetChats, otherChats := separateChatsByAuthor(chats, target)
 
-	if len(targetChats) != 0 {
-		// If the length of the targetChats is not 0, save the chats to the database
-		chatRecords := convertChatsToRecords(targetChats)
-		// Skip sentiment analysis of target chat during live
-		// Because the negativity flag isn't necessary for the use case when the chat is in live
-		if err := InsertChatRecord(ctx, dbClient, chatRecords); err != nil {
-			slog.Error("Failed to insert chat records",
-				slog.Group("saveChat", slog.Group("database", "error", err)),
-			)
-			return err
-		}
+	// Save the chats of the targets to the database along with the poll state
+	// Skip sentiment analysis of target chat during live
+	// Because the negativity flag isn't necessary for the use case when the chat is in live
+	targetRecords := convertChatsToRecords(targetChats)
+	run.AddChats(targetRecords)
+	// Chats from non-targets are analyzed independently by the downstream services
+	targetEvents := newChatEvents(AuthorClassTarget, targetRecords)
+	otherEvents := newChatEvents(AuthorClassOther, convertChatsToRecords(otherChats))
+	dispatcher, err := routeToSinks(ctx, repo, run, append(slices.Clone(targetEvents), otherEvents...))
+	if err != nil {
+		return err
+	}
+	if _, err := run.Commit(ctx, repo); err != nil {
+		return err
 	}
 
-	// Chats from non-targets are analyzed independently by an external service
-	// Skip if the URL of the external service is not set in the environment variable
-	serviceUrl := os.Getenv("EXTERNAL_SERVICE_URL")
-	if serviceUrl == "" {
-		slog.Info("No external service URL set")
-		return nil
+	// Publish the chats to the subscribers in the same process, such as the WebSocket hub
+	if !run.DryRun {
+		DefaultBroker().Publish(targetEvents...)
+		DefaultBroker().Publish(otherEvents...)
 	}
 
-	// Send the chats to the external service
-	httpClient := &http.Client{}
+	return dispatchToSinks(ctx, dispatcher, run)
+}
 
-	// Compress the otherChats with MessagePack
-	pack, err := msgpack.Marshal(otherChats)
+// routeToSinks queues the events in the outbox of the run for the sinks whose rules match them.
+// The batches are committed in the same transaction as the chats so that they survive the outage of the sinks.
+// It returns nil dispatcher if no sink is configured.
+func routeToSinks(ctx context.Context, repo ChatRepository, run *Run, events []ChatEvent) (*OutboxDispatcher, error) {
+	dispatcher, err := OutboxDispatcherFromEnv(repo)
 	if err != nil {
-		return err
+		slog.Error("Failed to create outbox dispatcher",
+			slog.Group("outbox", "error", err),
+		)
+		return nil, err
 	}
-
-	req, err := http.NewRequest("POST", serviceUrl, strings.NewReader(string(pack)))
-	if err != nil {
-		slog.Error("Failed to create request",
-			slog.Group("externalService", "error", err),
+	if dispatcher == nil {
+		slog.Info("No sink configured")
+		return nil, nil
+	}
+	if err := run.RouteOutbox(dispatcher.Sinks(), events, time.Now()); err != nil {
+		slog.Error("Failed to queue chats for sinks",
+			slog.Group("outbox", "error", err),
 		)
-		return err
+		return nil, err
+	}
+	return dispatcher, nil
+}
+
+// dispatchToSinks delivers the committed batches including the batches left by the previous runs.
+// The failed batches are retried by the next runs, so the failure does not fail the run.
+func dispatchToSinks(ctx context.Context, dispatcher *OutboxDispatcher, run *Run) error {
+	if dispatcher == nil || run.DryRun {
+		return nil
 	}
-	resp, err := httpClient.Do(req)
+	result, err := dispatcher.Drain(ctx)
+	run.CountForwarded(result.Delivered)
 	if err != nil {
-		return err
+		run.Fail("", "deliver", err)
 	}
-	defer func(resp *http.Response) {
-		err := resp.Body.Close()
-		if err != nil {
-			slog.Error("failed to close response body", "error", err)
-		}
-	}(resp)
-
 	return nil
 }
 
-func fetchChatsByChatID(ctx context.Context, ytSvc *youtube.Service, video VideoInfo, length int64) ([]Chat, error) {
+func fetchChatsByChatID(ctx context.Context, ytSvc *youtube.Service, video VideoInfo, length int64, pageToken string) ([]Chat, ChatCursor, error) {
 	call := ytSvc.LiveChatMessages.List(video.ChatID, []string{"snippet"})
 
 	// If length is not 0, set the length
@@ -313,6 +602,11 @@ func fetchChatsByChatID(ctx context.Context, ytSvc *youtube.Service, video Video
 		call = call.MaxResults(length)
 	}
 
+	// If pageToken is set, fetch only the chats after the previous response
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+
 	call = call.Context(ctx)
 
 	resp, err := call.Do()
@@ -321,7 +615,23 @@ func fetchChatsByChatID(ctx context.Context, ytSvc *youtube.Service, video Video
 			"Failed to run LiveChatMessages.List",
 			slog.Group("fetchChat", "chatId", video.ChatID, slog.Group("YouTubeAPI", "error", err)),
 		)
-		return nil, err
+		return nil, ChatCursor{}, err
+	}
+
+	cursor := ChatCursor{
+		NextPageToken:   resp.NextPageToken,
+		PollingInterval: time.Duration(resp.PollingIntervalMillis) * time.Millisecond,
+	}
+	// OfflineAt is set only when the chat went offline
+	if resp.OfflineAt != "" {
+		oa, err := synchro.ParseISO[tz.AsiaTokyo](resp.OfflineAt)
+		if err != nil {
+			slog.Error("Failed to parse offlineAt",
+				slog.Group("fetchChat", "chatID", video.ChatID, slog.Group("formatting", "error", err, "offlineAt", resp.OfflineAt)),
+			)
+			return nil, ChatCursor{}, err
+		}
+		cursor.OfflineAt = oa.StdTime()
 	}
 
 	result := make([]Chat, 0, len(resp.Items))
@@ -331,22 +641,24 @@ func fetchChatsByChatID(ctx context.Context, ytSvc *youtube.Service, video Video
 			slog.Error("Failed to parse publishedAt",
 				slog.Group("fetchChat", "chatID", video.ChatID, slog.Group("formatting", "error", err, "publishedAt", item.Snippet.PublishedAt)),
 			)
-			return nil, err
+			return nil, ChatCursor{}, err
 		}
 		result = append(result, Chat{
+			ID:              item.Id,
 			AuthorChannelID: item.Snippet.AuthorChannelId,
 			Message:         item.Snippet.DisplayMessage,
+			MessageType:     item.Snippet.Type,
 			PublishedAtUnix: pa.Unix(),
 			SourceID:        video.SourceID,
 		})
 	}
 
-	return result, nil
+	return result, cursor, nil
 }
 
-func fetchStaticTarget(ctx context.Context, db *bun.DB, ytSvc *youtube.Service, video VideoInfo, threshold int64, target []string) ([]Chat, error) {
+func fetchStaticTarget(ctx context.Context, repo ChatRepository, source ChatSource, video VideoInfo, threshold int64, target []string, run *Run) ([]Chat, error) {
 	// Get the last publishedAt of the record
-	pldRec, err := getLastPublishedAtOfRecordEachSource(ctx, db, []string{video.SourceID})
+	pldRec, err := repo.GetLastPublishedAtOfRecordEachSource(ctx, []string{video.SourceID})
 	if err != nil {
 		slog.Error("Failed to get last publishedAt of record",
 			slog.Group("fetchChat", "sourceId", video.SourceID, slog.Group("database", "error", err)),
@@ -359,93 +671,105 @@ func fetchStaticTarget(ctx context.Context, db *bun.DB, ytSvc *youtube.Service,
 		threshold = lastPublished
 	}
 
+	// Skip the poll if the chat is closed or the polling interval has not elapsed yet
+	polls, err := repo.GetPollRecordEachSource(ctx, []string{video.SourceID})
+	if err != nil {
+		slog.Error("Failed to get poll record",
+			slog.Group("fetchChat", "sourceId", video.SourceID, slog.Group("database", "error", err)),
+		)
+		return nil, err
+	}
+	if poll := polls[video.SourceID]; !poll.OfflineAt.IsZero() || !isPollDue(poll, time.Now()) {
+		return nil, nil
+	}
+
 	// Fetch chats by YouTube API
-	chats, err := fetchChatsByChatID(ctx, ytSvc, video, 0)
+	run.Touch(video.SourceID)
+	chats, cursor, err := source.FetchChats(ctx, video, "")
+	run.CountFetch(len(chats))
 	if err != nil {
 		slog.Error("Failed to fetch chats from YouTube API",
 			slog.Group("fetchChat", "chatId", video.ChatID, "error", err),
 		)
 		return nil, err
 	}
+	run.AddPoll(video, cursor, time.Now())
 
 	// Filter the chats by the threshold
+	fetched := len(chats)
 	chats = filterChatsByPublishedAt(chats, threshold)
+	run.CountFiltered(fetched - len(chats))
 	// Separate the chats by the author channel ID
 	targetChats, _ := separateChatsByAuthor(chats, target)
 
 	return targetChats, nil
 }
 
-func findPriorityTarget(ctx context.Context, db *bun.DB, videos []VideoInfo) (VideoInfo, int64, error) {
-	// Get the last publishedAt of the record in each upcoming video
-	if len(videos) == 0 {
-		slog.Error(
-			"Failed to find priority target",
-			slog.Group("fetchChat", "error", "no videos"),
+// fetchUpcomingTarget fetches the chats of the upcoming video picked by findPriorityTarget.
+// It is called with the lease of the video, so the last publishedAt includes the chats saved by the run that held the lease.
+func fetchUpcomingTarget(ctx context.Context, repo ChatRepository, source ChatSource, video VideoInfo, target []string, run *Run) ([]Chat, error) {
+	// Get the last publishedAt of the record of the target video
+	// to filter the chats that are already saved
+	rec, err := repo.GetLastPublishedAtOfRecordEachSource(ctx, []string{video.SourceID})
+	if err != nil {
+		slog.Error("Failed to get last publishedAt of record",
+			slog.Group("fetchChat", "sourceId", video.SourceID, slog.Group("database", "error", err)),
 		)
-		return VideoInfo{}, 0, fmt.Errorf("no videos")
-	}
-
-	ids := make([]string, len(videos))
-	for i, video := range videos {
-		ids[i] = video.SourceID
+		return nil, err
 	}
+	lastPublished := rec[video.SourceID]
 
-	rec, err := getLastPublishedAtOfRecordEachSource(ctx, db, ids)
+	// Fetch chats from upcoming videos
+	run.Touch(video.SourceID)
+	upcomingChats, cursor, err := source.FetchChats(ctx, video, "")
+	run.CountFetch(len(upcomingChats))
 	if err != nil {
-		slog.Error("Failed to get last publishedAt of record",
-			slog.Group("fetchChat", "sourceId", ids, slog.Group("database", "error", err)),
-		)
-		return VideoInfo{}, 0, err
-	}
-
-	switch {
-	case len(rec) == 0:
-		return videos[0], 0, nil
-	case len(videos) == 1:
-		return videos[0], rec[videos[0].SourceID], nil
-	case len(videos) != len(rec):
-		for _, video := range videos {
-			if _, ok := rec[video.SourceID]; !ok {
-				return video, 0, nil
-			}
-		}
+		// The failed poll is recorded too, or the video would stay the most overdue and be picked in every run
+		run.AddPoll(video, ChatCursor{}, time.Now())
+		return nil, err
 	}
+	// Record the poll so that the other upcoming videos get their turn in the next runs
+	run.AddPoll(video, cursor, time.Now())
+	slog.Info(
+		"Fetched chats from upcoming video",
+		slog.Group("fetchChat", "chatId", video.ChatID, slog.Group("upcoming", "sourceId", video.SourceID, "count", len(upcomingChats))),
+	)
+	// Filter the chats by the threshold if the lastPublished is not 0
+	// If the lastPublished is 0, the chats are not filtered and all chats are returned
+	if lastPublished != 0 {
+		fetched := len(upcomingChats)
+		upcomingChats = filterChatsByPublishedAt(upcomingChats, lastPublished)
+		run.CountFiltered(fetched - len(upcomingChats))
+	}
+	// Filter the chats by the target channels
+	upcomingChats, _ = separateChatsByAuthor(upcomingChats, target)
 
-	var target VideoInfo
-	var targetSourceID string
-	var latestPublished int64
+	return upcomingChats, nil
+}
 
-	// Priority is given to retrieving the last saved data with the oldest PublishedAt.
-	// The data with the smallest value in map is the priority target
-	vals := make([]int64, 0, len(rec))
-	for _, published := range rec {
-		vals = append(vals, published)
+func findPriorityTarget(videos []VideoInfo, polls map[string]PollRecord, interval time.Duration) (VideoInfo, error) {
+	if len(videos) == 0 {
+		slog.Error(
+			"Failed to find priority target",
+			slog.Group("fetchChat", "error", "no videos"),
+		)
+		return VideoInfo{}, fmt.Errorf("no videos")
 	}
-	// Find the smallest value
-	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
-	latestPublished = vals[0]
 
-	// Find the sourceID with the smallest value in the map
-	for sourceID, published := range rec {
-		if published == latestPublished {
-			targetSourceID = sourceID
-			break
-		}
+	// Get the last polled time of each upcoming video
+	polled := make(map[string]time.Time, len(polls))
+	for sourceID, poll := range polls {
+		polled[sourceID] = poll.LastPolledAt
 	}
 
-	// Find the target video info
-	for _, video := range videos {
-		if video.SourceID == targetSourceID {
-			target = video
-			break
-		}
-	}
+	// Priority is given to the video waiting for the poll the longest,
+	// weighted by the proximity of the scheduled start time.
+	target, _ := NewPollScheduler(interval).Pick(videos, polled, time.Now())
 
-	return target, latestPublished, nil
+	return target, nil
 }
 
-func validateNegativitySentiment(ctx context.Context, nlClient *language.Client, chats []ChatRecord) ([]ChatRecord, error) {
+func validateNegativitySentiment(ctx context.Context, nlClient *language.Client, chats []ChatRecord, run *Run) ([]ChatRecord, error) {
 	// Validate the negativity sentiment of the chats
 	// The chats are validated by the sentiment analysis of the Natural Language API
 	// If the sentiment is negative, the chat is appended to the result
@@ -467,20 +791,24 @@ func validateNegativitySentiment(ctx context.Context, nlClient *language.Client,
 		msg = RemoveEmoji(msg)
 
 		if len(msg) == 0 {
+			run.Sentiment.Skipped++
 			chat.IsNegative = false
 			result = append(result, chat)
 			continue
 		}
 
 		// Analyze the sentiment of the message
+		run.Record.SentimentCalls++
 		score, magnitude, err := AnalyzeSentiment(ctx, nlClient, msg)
 		if err != nil {
 			return nil, err
 		}
+		run.Sentiment.Analyzed++
 
 		// If score is less than -1 * magnitude, treat the message as negative
 		// when score is another case, treat the message as non-negative
 		if score < -1*magnitude {
+			run.Sentiment.Negative++
 			chat.IsNegative = true
 			result = append(result, chat)
 			continue
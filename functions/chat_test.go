@@ -0,0 +1,161 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFetchUpcomingTargetReadsLastPublishedAfterLock(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	video := VideoInfo{SourceID: "upcoming", ChatID: "chat-upcoming", ScheduledAt: now.Add(time.Hour)}
+
+	source := NewFakeChatSource()
+	source.Push("chat-upcoming",
+		Chat{ID: "1", AuthorChannelID: "target", Message: "first", PublishedAtUnix: now.Unix()},
+		Chat{ID: "2", AuthorChannelID: "target", Message: "second", PublishedAtUnix: now.Unix() + 1},
+	)
+
+	target, err := findPriorityTarget([]VideoInfo{video}, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The run holding the lease saves the first chat while this run waits for the lease
+	run := NewRun(60)
+	if ok, err := run.Lock(ctx, repo, target.SourceID, time.Minute, 0); err != nil || !ok {
+		t.Fatalf("lock = %v, %v", ok, err)
+	}
+	defer run.Unlock(ctx, repo)
+	if err := repo.InsertChatRecord(ctx, []ChatRecord{{ID: "1", Message: "first", SourceID: "upcoming", PublishedAt: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	chats, err := fetchUpcomingTarget(ctx, repo, source, target, []string{"target"}, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 1 || chats[0].ID != "2" {
+		t.Errorf("chats = %+v, want only the chat after the saved one", chats)
+	}
+	if run.Record.Filtered != 1 {
+		t.Errorf("filtered = %d, want 1", run.Record.Filtered)
+	}
+}
+
+func TestRunOptionsSkipSentimentRequiresDryRun(t *testing.T) {
+	if err := (RunOptions{SkipSentiment: true}).validate(); err == nil {
+		t.Error("skipSentiment without dryRun is valid")
+	}
+	if err := (RunOptions{SkipSentiment: true, DryRun: true}).validate(); err != nil {
+		t.Errorf("skipSentiment with dryRun: %v", err)
+	}
+}
+
+func TestChatWatcherDryRunRequiresToken(t *testing.T) {
+	t.Setenv("LOCAL_ONLY", "true")
+	t.Setenv("YOUTUBE_API_KEY", "key")
+	t.Setenv("DSN", "file::memory:")
+	t.Setenv("TARGET_CHANNEL_ID", "target")
+	t.Setenv("STATIC_TARGET", `{"sourceId":"static","chatId":"chat-static"}`)
+	t.Setenv("ADMIN_TOKENS", "secret")
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{name: "dry run", query: "?dryRun=true", want: http.StatusUnauthorized},
+		{name: "skip sentiment with dry run", query: "?dryRun=true&skipSentiment=true", want: http.StatusUnauthorized},
+		{name: "skip sentiment without dry run", query: "?skipSentiment=true", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			chatWatcher(rec, httptest.NewRequest(http.MethodGet, "/"+tt.query, nil))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+// brokenChatSource fails the fetches of the chat and counts the fetches of each video
+type brokenChatSource struct {
+	ChatSource
+	broken  string
+	fetched map[string]int
+}
+
+func (s *brokenChatSource) FetchChats(ctx context.Context, video VideoInfo, pageToken string) ([]Chat, ChatCursor, error) {
+	s.fetched[video.SourceID]++
+	if video.ChatID == s.broken {
+		return nil, ChatCursor{}, errors.New("broken chat")
+	}
+	return s.ChatSource.FetchChats(ctx, video, pageToken)
+}
+
+func TestWatchChatsBrokenUpcomingDoesNotStarveOthers(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	now := time.Now()
+	insertVideos(t, repo,
+		VideoRecord{SourceID: "a", Status: "upcoming", ChatID: "chat-a", ScheduledAt: now.Add(time.Hour), UpdatedAt: now},
+		VideoRecord{SourceID: "b", Status: "upcoming", ChatID: "chat-b", ScheduledAt: now.Add(time.Hour), UpdatedAt: now},
+		VideoRecord{SourceID: "c", Status: "upcoming", ChatID: "chat-c", ScheduledAt: now.Add(time.Hour), UpdatedAt: now},
+	)
+	source := &brokenChatSource{ChatSource: NewFakeChatSource(), broken: "chat-a", fetched: make(map[string]int)}
+	opts := watchOptions{
+		targetChannels: []string{"target"},
+		pollInterval:   time.Hour,
+		lockTTL:        time.Minute,
+		mode:           RunModeUpcoming,
+	}
+
+	// The broken video is picked first because it has never been polled, and then the others get their turn
+	for i := 0; i < 3; i++ {
+		run := NewRun(60)
+		if err := watchChats(ctx, source, repo, opts, run); err != nil {
+			t.Fatal(err)
+		}
+		run.Unlock(ctx, repo)
+	}
+	want := map[string]int{"a": 1, "b": 1, "c": 1}
+	if !reflect.DeepEqual(source.fetched, want) {
+		t.Errorf("fetched = %v, want %v", source.fetched, want)
+	}
+}
+
+func TestFetchStaticTargetCountsOnlyThresholdAsFiltered(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	video := VideoInfo{SourceID: "static", ChatID: "chat-static"}
+	insertVideos(t, repo, VideoRecord{SourceID: "static", Status: "static", ChatID: "chat-static", UpdatedAt: now})
+
+	source := NewFakeChatSource()
+	source.Push("chat-static",
+		Chat{ID: "1", AuthorChannelID: "target", Message: "saved", PublishedAtUnix: now.Unix()},
+		Chat{ID: "2", AuthorChannelID: "viewer", Message: "viewer", PublishedAtUnix: now.Unix() + 1},
+		Chat{ID: "3", AuthorChannelID: "target", Message: "new", PublishedAtUnix: now.Unix() + 2},
+	)
+
+	run := NewRun(60)
+	chats, err := fetchStaticTarget(ctx, repo, source, video, now.Unix(), []string{"target"}, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 1 || chats[0].ID != "3" {
+		t.Errorf("chats = %+v, want only chat 3", chats)
+	}
+	// Only the chat at the threshold is filtered, the chat of the viewer is not
+	if run.Record.Fetched != 3 || run.Record.Filtered != 1 {
+		t.Errorf("fetched = %d, filtered = %d, want 3 and 1", run.Record.Fetched, run.Record.Filtered)
+	}
+}
@@ -0,0 +1,166 @@
+package functions
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChatPage is the response of chatsHandler
+type ChatPage struct {
+	Chats []ChatRecord `json:"chats"`
+	// NextCursor is passed as the cursor query to get the next page, and empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// chatsHandler returns the saved chats for the front-end.
+// The chats are filtered by the queries:
+// sourceId (repeatable), from and to (RFC 3339), author, negative (true or false), type, limit and cursor.
+// The response is MessagePack if format=msgpack or the Accept header is application/msgpack, and JSON otherwise.
+func chatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Set custom logger
+	logger := NewCustomLogger(ctx)
+	slog.SetDefault(logger)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := getChatQuery(r.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repo, err := getChatRepository(ctx)
+	if err != nil {
+		slog.Error("Failed to create Database client",
+			slog.Group("database", "error", err),
+		)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// One more chat is requested to know whether the next page exists
+	limit := query.Limit
+	query.Limit++
+	records, err := repo.ListChatRecords(ctx, query)
+	if err != nil {
+		slog.Error("Failed to list chat records",
+			slog.Group("chats", slog.Group("database", "error", err)),
+		)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := ChatPage{Chats: records}
+	if len(records) > limit {
+		page.Chats = records[:limit]
+		last := page.Chats[limit-1]
+		page.NextCursor = encodeChatCursor(ChatKey{PublishedAt: last.PublishedAt, ID: last.ID})
+	}
+
+	if wantsMsgpack(r) {
+		w.Header().Set("Content-Type", "application/msgpack")
+		enc := msgpack.NewEncoder(w)
+		// The keys are the same as JSON
+		enc.SetCustomStructTag("json")
+		if err := enc.Encode(page); err != nil {
+			slog.Error("Failed to write chat records", "error", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		slog.Error("Failed to write chat records", "error", err)
+	}
+}
+
+func getChatQuery(u *url.URL) (ChatQuery, error) {
+	// Default value is 100 chats, and at most 1000 chats are returned at once
+	defVal := 100
+	maxVal := 1000
+
+	values := u.Query()
+	query := ChatQuery{
+		SourceIDs:   values["sourceId"],
+		Author:      values.Get("author"),
+		MessageType: values.Get("type"),
+		Limit:       defVal,
+	}
+
+	var err error
+	if v := values.Get("from"); v != "" {
+		if query.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return ChatQuery{}, fmt.Errorf("invalid from: %s", v)
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if query.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return ChatQuery{}, fmt.Errorf("invalid to: %s", v)
+		}
+	}
+	if v := values.Get("negative"); v != "" {
+		negative, err := strconv.ParseBool(v)
+		if err != nil {
+			return ChatQuery{}, fmt.Errorf("invalid negative: %s", v)
+		}
+		query.IsNegative = &negative
+	}
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return ChatQuery{}, fmt.Errorf("invalid limit: %s", v)
+		}
+		if limit > maxVal {
+			return ChatQuery{}, fmt.Errorf("limit value too large: %d exceeds maximum of %d", limit, maxVal)
+		}
+		query.Limit = limit
+	}
+	if v := values.Get("cursor"); v != "" {
+		key, err := decodeChatCursor(v)
+		if err != nil {
+			return ChatQuery{}, fmt.Errorf("invalid cursor: %s", v)
+		}
+		query.After = &key
+	}
+
+	return query, nil
+}
+
+// The cursor is the key of the last chat of the page encoded in URL-safe base64
+func encodeChatCursor(key ChatKey) string {
+	b, _ := json.Marshal(key)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeChatCursor(cursor string) (ChatKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ChatKey{}, err
+	}
+	var key ChatKey
+	if err := json.Unmarshal(b, &key); err != nil {
+		return ChatKey{}, err
+	}
+	return key, nil
+}
+
+func wantsMsgpack(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "msgpack"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/msgpack") || strings.Contains(accept, "application/x-msgpack")
+}
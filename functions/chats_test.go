@@ -0,0 +1,207 @@
+package functions
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGetChatQuery(t *testing.T) {
+	from := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	cursor := encodeChatCursor(ChatKey{PublishedAt: from, ID: "id1"})
+
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+		check   func(t *testing.T, q ChatQuery)
+	}{
+		{name: "default", query: "", check: func(t *testing.T, q ChatQuery) {
+			if q.Limit != 100 || q.After != nil || q.IsNegative != nil || !q.From.IsZero() || !q.To.IsZero() {
+				t.Errorf("query = %+v, want the default", q)
+			}
+		}},
+		{name: "all filters", query: "sourceId=a&sourceId=b&from=2024-04-01T12:00:00Z&to=2024-04-01T13:00:00Z&author=ch&negative=true&type=superChatEvent&limit=10&cursor=" + cursor, check: func(t *testing.T, q ChatQuery) {
+			if len(q.SourceIDs) != 2 || q.SourceIDs[0] != "a" || q.SourceIDs[1] != "b" {
+				t.Errorf("SourceIDs = %v, want [a b]", q.SourceIDs)
+			}
+			if !q.From.Equal(from) || !q.To.Equal(from.Add(time.Hour)) {
+				t.Errorf("From, To = %v, %v", q.From, q.To)
+			}
+			if q.Author != "ch" || q.MessageType != "superChatEvent" || q.Limit != 10 {
+				t.Errorf("query = %+v", q)
+			}
+			if q.IsNegative == nil || !*q.IsNegative {
+				t.Errorf("IsNegative = %v, want true", q.IsNegative)
+			}
+			if q.After == nil || q.After.ID != "id1" || !q.After.PublishedAt.Equal(from) {
+				t.Errorf("After = %+v, want id1 at %v", q.After, from)
+			}
+		}},
+		{name: "maximum limit", query: "limit=1000", check: func(t *testing.T, q ChatQuery) {
+			if q.Limit != 1000 {
+				t.Errorf("Limit = %d, want 1000", q.Limit)
+			}
+		}},
+		{name: "invalid from", query: "from=2024-04-01", wantErr: true},
+		{name: "invalid to", query: "to=yesterday", wantErr: true},
+		{name: "invalid negative", query: "negative=maybe", wantErr: true},
+		{name: "non-numeric limit", query: "limit=ten", wantErr: true},
+		{name: "zero limit", query: "limit=0", wantErr: true},
+		{name: "negative limit", query: "limit=-1", wantErr: true},
+		{name: "too large limit", query: "limit=1001", wantErr: true},
+		{name: "cursor not base64", query: "cursor=%21%21", wantErr: true},
+		{name: "cursor not JSON", query: "cursor=" + base64.RawURLEncoding.EncodeToString([]byte("id1")), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse("/chats?" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := getChatQuery(u)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("err = nil, want an error for %q", tt.query)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, q)
+		})
+	}
+}
+
+func TestChatCursorRoundTrip(t *testing.T) {
+	key := ChatKey{PublishedAt: time.Date(2024, 4, 1, 12, 0, 0, 123456789, time.UTC), ID: "id/+1"}
+	got, err := decodeChatCursor(encodeChatCursor(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != key.ID || !got.PublishedAt.Equal(key.PublishedAt) {
+		t.Errorf("key = %+v, want %+v", got, key)
+	}
+}
+
+func TestChatsHandler(t *testing.T) {
+	t.Setenv("LOCAL_ONLY", "true")
+	repo := newTestRepository(t)
+	useTestRepository(t, repo)
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	if err := repo.InsertChatRecord(context.Background(), []ChatRecord{
+		{ID: "id1", Message: "m1", SourceID: "video", PublishedAt: now},
+		{ID: "id2", Message: "m2", SourceID: "video", PublishedAt: now.Add(time.Second)},
+		{ID: "id3", Message: "m3", SourceID: "video", PublishedAt: now.Add(2 * time.Second)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T, target, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		chatsHandler(rec, req)
+		return rec
+	}
+	ids := func(page ChatPage) []string {
+		var ids []string
+		for _, c := range page.Chats {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		var pages [][]string
+		target := "/chats?sourceId=video&limit=2"
+		for {
+			rec := get(t, target, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var page ChatPage
+			if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			pages = append(pages, ids(page))
+			if page.NextCursor == "" {
+				break
+			}
+			target = "/chats?sourceId=video&limit=2&cursor=" + page.NextCursor
+		}
+		if len(pages) != 2 || len(pages[0]) != 2 || len(pages[1]) != 1 || pages[1][0] != "id3" {
+			t.Errorf("pages = %v, want [[id1 id2] [id3]]", pages)
+		}
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		for _, target := range []string{"/chats?limit=1001", "/chats?cursor=%21%21"} {
+			if rec := get(t, target, ""); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: status = %d, want %d", target, rec.Code, http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		chatsHandler(rec, httptest.NewRequest(http.MethodPost, "/chats", nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+		}
+	})
+
+	t.Run("msgpack", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			target  string
+			accept  string
+			msgpack bool
+		}{
+			{name: "accept", target: "/chats", accept: "application/msgpack", msgpack: true},
+			{name: "accept x-msgpack", target: "/chats", accept: "application/json;q=0.5, application/x-msgpack", msgpack: true},
+			{name: "format", target: "/chats?format=msgpack", msgpack: true},
+			{name: "format overrides accept", target: "/chats?format=json", accept: "application/msgpack"},
+			{name: "default", target: "/chats", accept: "*/*"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rec := get(t, tt.target, tt.accept)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+				}
+				var page ChatPage
+				if tt.msgpack {
+					if ct := rec.Header().Get("Content-Type"); ct != "application/msgpack" {
+						t.Errorf("Content-Type = %s, want application/msgpack", ct)
+					}
+					dec := msgpack.NewDecoder(rec.Body)
+					dec.SetCustomStructTag("json")
+					if err := dec.Decode(&page); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+						t.Errorf("Content-Type = %s, want application/json", ct)
+					}
+					if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if len(page.Chats) != 3 || page.Chats[0].ID != "id1" || !page.Chats[0].PublishedAt.Equal(now) {
+					t.Errorf("chats = %+v, want id1, id2 and id3", page.Chats)
+				}
+			})
+		}
+	})
+}
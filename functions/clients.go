@@ -0,0 +1,83 @@
+package functions
+
+import (
+	language "cloud.google.com/go/language/apiv2"
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// The clients are shared by the invocations on the same instance.
+// Cloud Functions reuses a warm instance for the following requests,
+// so the connection pools are created on the first request and kept until the instance is shut down.
+var (
+	repoClient     lazyClient[ChatRepository]
+	sourceClient   lazyClient[ChatSource]
+	analysisClient lazyClient[*language.Client]
+	sinkRegistry   lazyClient[*SinkRegistry]
+)
+
+// lazyClient initializes a client on the first successful call of get.
+// Unlike sync.Once, a failed initialization is retried by the next call.
+type lazyClient[T any] struct {
+	mu    sync.Mutex
+	value T
+	ready bool
+}
+
+func (c *lazyClient[T]) get(init func() (T, error)) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ready {
+		return c.value, nil
+	}
+
+	v, err := init()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	c.value = v
+	c.ready = true
+
+	return v, nil
+}
+
+// getChatRepository returns the process-wide repository configured by DBConfigFromEnv
+func getChatRepository(ctx context.Context) (ChatRepository, error) {
+	return repoClient.get(func() (ChatRepository, error) {
+		cfg, err := DBConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		// The pool outlives the request, so it is not bound to the context of the request
+		repo, err := NewChatRepository(context.WithoutCancel(ctx), cfg)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Connected to database",
+			slog.Group("database", "maxOpenConns", cfg.MaxOpenConns, "connMaxLifetime", cfg.ConnMaxLifetime, "statementTimeout", cfg.StatementTimeout),
+		)
+		return repo, nil
+	})
+}
+
+// getChatSource returns the process-wide chat source created by NewChatSource
+func getChatSource(ctx context.Context, ytApiKey string) (ChatSource, error) {
+	return sourceClient.get(func() (ChatSource, error) {
+		return NewChatSource(context.WithoutCancel(ctx), ytApiKey)
+	})
+}
+
+// getSinkRegistry returns the process-wide sinks configured by SinkRegistryFromEnv
+func getSinkRegistry() (*SinkRegistry, error) {
+	return sinkRegistry.get(SinkRegistryFromEnv)
+}
+
+// getAnalysisClient returns the process-wide client of Natural Language API
+func getAnalysisClient(ctx context.Context) (*language.Client, error) {
+	return analysisClient.get(func() (*language.Client, error) {
+		return NewAnalysisClient(context.WithoutCancel(ctx))
+	})
+}
@@ -7,17 +7,206 @@ import (
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/pgdialect"
 	"github.com/uptrace/bun/driver/pgdriver"
+	"os"
+	"strings"
+	"time"
 )
 
-func NewDBClient(dsn string) (*bun.DB, error) {
-	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
+// ChatRepository is the storage of the videos, the chats and the poll state of each video
+type ChatRepository interface {
+	GetVideoRecordByStatus(ctx context.Context, status []string) ([]VideoRecord, error)
+	GetLastPublishedAtOfRecordEachSource(ctx context.Context, source []string) (map[string]int64, error)
+	GetPollRecordEachSource(ctx context.Context, source []string) (map[string]PollRecord, error)
+	UpsertPollRecord(ctx context.Context, record PollRecord) error
+	InsertChatRecord(ctx context.Context, record []ChatRecord) error
+	InsertRunRecord(ctx context.Context, record *RunRecord) error
+	InsertOutboxRecords(ctx context.Context, records []OutboxRecord) error
+	// ListPendingOutboxRecords returns the first limit pending batches of each sink and source in the order of insertion
+	ListPendingOutboxRecords(ctx context.Context, limit int) ([]OutboxRecord, error)
+	UpdateOutboxRecord(ctx context.Context, record OutboxRecord) error
+	// AcquireLease takes the lease of name for ttl unless another holder has an unexpired lease.
+	// It returns false when the lease is held by another holder.
+	AcquireLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, name string, holder string) error
+	// GetChatRecordByID returns sql.ErrNoRows when no chat has the message ID
+	GetChatRecordByID(ctx context.Context, id string) (ChatRecord, error)
+	// ListChatRecords returns the chats matching the query in the order of publishedAt
+	ListChatRecords(ctx context.Context, query ChatQuery) ([]ChatRecord, error)
+	// GetChatSourceIDs returns the source IDs that have at least one chat
+	GetChatSourceIDs(ctx context.Context) ([]string, error)
+	GetVideoRecordEachSource(ctx context.Context, source []string) (map[string]VideoRecord, error)
+	UpdateVideoStatus(ctx context.Context, sourceID string, status string, updatedAt time.Time) error
+	CountChatRecordsBefore(ctx context.Context, sourceID string, before time.Time) (int, error)
+	// GetChatRecordsBefore returns at most limit chats of the source published before the time, the oldest first
+	GetChatRecordsBefore(ctx context.Context, sourceID string, before time.Time, limit int) ([]ChatRecord, error)
+	DeleteChatRecords(ctx context.Context, records []ChatRecord) error
+	InsertChatArchiveRecord(ctx context.Context, record *ChatArchiveRecord) error
+	// ListRunRecords returns the latest runs first
+	ListRunRecords(ctx context.Context, limit int) ([]RunRecord, error)
+	// RunInTx runs fn with the repository bound to a transaction.
+	// The transaction is committed when fn returns nil, and rolled back otherwise.
+	RunInTx(ctx context.Context, fn func(ctx context.Context, repo ChatRepository) error) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// ChatQuery is the filter of ListChatRecords. The zero values match all the chats.
+type ChatQuery struct {
+	SourceIDs []string
+	// From and To are the inclusive and exclusive bounds of publishedAt
+	From        time.Time
+	To          time.Time
+	Author      string
+	IsNegative  *bool
+	MessageType string
+	// After is the key of the last chat of the previous page
+	After *ChatKey
+	Limit int
+}
+
+// ChatKey identifies the position of a chat in the order of ListChatRecords
+type ChatKey struct {
+	PublishedAt time.Time `json:"publishedAt"`
+	ID          string    `json:"id"`
+}
+
+// DBConfig is the connection settings of the database
+type DBConfig struct {
+	DSN string
+	// MaxOpenConns and MaxIdleConns limit the connection pool (0 means the default of database/sql)
+	MaxOpenConns int
+	MaxIdleConns int
+	// ConnMaxLifetime closes the connections older than it (0 means no limit)
+	ConnMaxLifetime time.Duration
+	// StatementTimeout cancels the statements running longer than it on the server (0 means no limit)
+	StatementTimeout time.Duration
+}
+
+// DBConfigFromEnv reads DSN and the optional pool settings:
+// DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME and DB_STATEMENT_TIMEOUT.
+// The durations are duration strings such as "5m" or "30s".
+func DBConfigFromEnv() (DBConfig, error) {
+	cfg := DBConfig{DSN: os.Getenv("DSN")}
+	if cfg.DSN == "" {
+		return DBConfig{}, fmt.Errorf("DSN is not set")
+	}
+
+	var err error
+	if cfg.MaxOpenConns, err = getIntEnv("DB_MAX_OPEN_CONNS"); err != nil {
+		return DBConfig{}, err
+	}
+	if cfg.MaxIdleConns, err = getIntEnv("DB_MAX_IDLE_CONNS"); err != nil {
+		return DBConfig{}, err
+	}
+	if cfg.ConnMaxLifetime, err = getDurationEnv("DB_CONN_MAX_LIFETIME"); err != nil {
+		return DBConfig{}, err
+	}
+	if cfg.StatementTimeout, err = getDurationEnv("DB_STATEMENT_TIMEOUT"); err != nil {
+		return DBConfig{}, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg DBConfig) applyPool(sqldb *sql.DB) {
+	if cfg.MaxOpenConns > 0 {
+		sqldb.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		sqldb.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		sqldb.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+}
+
+// NewChatRepository opens the repository for cfg.DSN and checks the connection.
+// A DSN starting with "sqlite:" or "file:" opens a SQLite database, and the others open a Postgres database.
+func NewChatRepository(ctx context.Context, cfg DBConfig) (ChatRepository, error) {
+	var repo ChatRepository
+	var err error
+	switch {
+	case strings.HasPrefix(cfg.DSN, "sqlite:"):
+		repo, err = NewSQLiteRepository(ctx, strings.TrimPrefix(strings.TrimPrefix(cfg.DSN, "sqlite:"), "//"), cfg)
+	case strings.HasPrefix(cfg.DSN, "file:"):
+		repo, err = NewSQLiteRepository(ctx, cfg.DSN, cfg)
+	default:
+		repo, err = NewPostgresRepository(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := repo.Ping(ctx); err != nil {
+		_ = repo.Close()
+		return nil, fmt.Errorf("failed to connect to database (check DSN and network): %w", err)
+	}
+
+	return repo, nil
+}
+
+func NewDBClient(cfg DBConfig) (*bun.DB, error) {
+	opts := []pgdriver.Option{pgdriver.WithDSN(cfg.DSN)}
+	if cfg.StatementTimeout > 0 {
+		opts = append(opts, pgdriver.WithConnParams(map[string]interface{}{
+			"statement_timeout": cfg.StatementTimeout.Milliseconds(),
+		}))
+	}
+	sqldb := sql.OpenDB(pgdriver.NewConnector(opts...))
+	cfg.applyPool(sqldb)
+
 	db := bun.NewDB(sqldb, pgdialect.New())
 	return db, nil
 }
 
-func getVideoRecordByStatus(ctx context.Context, db *bun.DB, status []string) ([]VideoRecord, error) {
+// PostgresRepository is the repository on Postgres, the database used in production
+type PostgresRepository struct {
+	bunRepository
+}
+
+func NewPostgresRepository(cfg DBConfig) (*PostgresRepository, error) {
+	db, err := NewDBClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresRepository{bunRepository{db: db}}, nil
+}
+
+// bunRepository implements the queries shared by the dialects supported by bun
+type bunRepository struct {
+	db *bun.DB
+	// tx is set when the repository is bound to a transaction by RunInTx
+	tx bun.IDB
+}
+
+func (r *bunRepository) idb() bun.IDB {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
+func (r *bunRepository) RunInTx(ctx context.Context, fn func(ctx context.Context, repo ChatRepository) error) error {
+	// Nested transactions are merged into the outer one
+	if r.tx != nil {
+		return fn(ctx, r)
+	}
+	return r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		return fn(ctx, &bunRepository{db: r.db, tx: tx})
+	})
+}
+
+func (r *bunRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r *bunRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *bunRepository) GetVideoRecordByStatus(ctx context.Context, status []string) ([]VideoRecord, error) {
 	records := make([]VideoRecord, 0)
-	err := db.NewSelect().Model(&records).Where("status IN (?)", bun.In(status)).Column("source_id", "status", "chat_id").Scan(ctx)
+	err := r.idb().NewSelect().Model(&records).Where("status IN (?)", bun.In(status)).Column("source_id", "status", "chat_id", "scheduled_at").Scan(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -26,16 +215,16 @@ func getVideoRecordByStatus(ctx context.Context, db *bun.DB, status []string) ([
 
 }
 
-func getLastPublishedAtOfRecordEachSource(ctx context.Context, db *bun.DB, source []string) (map[string]int64, error) {
+func (r *bunRepository) GetLastPublishedAtOfRecordEachSource(ctx context.Context, source []string) (map[string]int64, error) {
 	if len(source) == 0 {
 		return nil, fmt.Errorf("source is empty")
 	}
 	// Get the last recorded chat
 	records := make([]ChatRecord, 0)
-	err := db.NewSelect().
+	err := r.idb().NewSelect().
 		Model(&records).
 		ColumnExpr("source_id, MAX(published_at) as published_at").
-		Where("source_id IN (?)", source).
+		Where("source_id IN (?)", bun.In(source)).
 		Group("source_id").
 		Scan(ctx)
 	if err != nil {
@@ -50,8 +239,295 @@ func getLastPublishedAtOfRecordEachSource(ctx context.Context, db *bun.DB, sourc
 	return result, nil
 }
 
-func InsertChatRecord(ctx context.Context, db *bun.DB, record []ChatRecord) error {
-	_, err := db.NewInsert().Model(&record).Exec(ctx)
+func (r *bunRepository) GetPollRecordEachSource(ctx context.Context, source []string) (map[string]PollRecord, error) {
+	if len(source) == 0 {
+		return nil, fmt.Errorf("source is empty")
+	}
+	records := make([]PollRecord, 0)
+	err := r.idb().NewSelect().
+		Model(&records).
+		Where("source_id IN (?)", bun.In(source)).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]PollRecord)
+	for _, record := range records {
+		result[record.SourceID] = record
+	}
+
+	return result, nil
+}
+
+func (r *bunRepository) UpsertPollRecord(ctx context.Context, record PollRecord) error {
+	_, err := r.idb().NewInsert().
+		Model(&record).
+		On("CONFLICT (source_id) DO UPDATE").
+		Set("chat_id = EXCLUDED.chat_id").
+		Set("last_polled_at = EXCLUDED.last_polled_at").
+		Set("next_poll_at = EXCLUDED.next_poll_at").
+		Set("polling_interval_millis = EXCLUDED.polling_interval_millis").
+		Set("offline_at = EXCLUDED.offline_at").
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *bunRepository) InsertChatRecord(ctx context.Context, record []ChatRecord) error {
+	_, err := r.idb().NewInsert().Model(&record).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *bunRepository) InsertRunRecord(ctx context.Context, record *RunRecord) error {
+	_, err := r.idb().NewInsert().Model(record).Returning("id").Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *bunRepository) ListRunRecords(ctx context.Context, limit int) ([]RunRecord, error) {
+	records := make([]RunRecord, 0)
+	err := r.idb().NewSelect().
+		Model(&records).
+		Order("started_at DESC").
+		Limit(limit).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *bunRepository) AcquireLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	lease := LeaseRecord{
+		Name:      name,
+		Holder:    holder,
+		ExpiresAt: now.Add(ttl),
+	}
+	// The existing lease is taken over only when it has expired or is held by the same holder
+	res, err := r.idb().NewInsert().
+		Model(&lease).
+		On("CONFLICT (name) DO UPDATE").
+		Set("holder = EXCLUDED.holder").
+		Set("expires_at = EXCLUDED.expires_at").
+		Where("?TableAlias.expires_at < ? OR ?TableAlias.holder = ?", now, holder).
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (r *bunRepository) ReleaseLease(ctx context.Context, name string, holder string) error {
+	_, err := r.idb().NewDelete().
+		Model((*LeaseRecord)(nil)).
+		Where("name = ?", name).
+		Where("holder = ?", holder).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *bunRepository) GetChatSourceIDs(ctx context.Context) ([]string, error) {
+	ids := make([]string, 0)
+	err := r.idb().NewSelect().
+		Model((*ChatRecord)(nil)).
+		Distinct().
+		Column("source_id").
+		Order("source_id").
+		Scan(ctx, &ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (r *bunRepository) GetVideoRecordEachSource(ctx context.Context, source []string) (map[string]VideoRecord, error) {
+	if len(source) == 0 {
+		return nil, fmt.Errorf("source is empty")
+	}
+	records := make([]VideoRecord, 0)
+	err := r.idb().NewSelect().
+		Model(&records).
+		Where("source_id IN (?)", bun.In(source)).
+		Column("source_id", "status", "chat_id", "scheduled_at").
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]VideoRecord)
+	for _, record := range records {
+		result[record.SourceID] = record
+	}
+
+	return result, nil
+}
+
+func (r *bunRepository) UpdateVideoStatus(ctx context.Context, sourceID string, status string, updatedAt time.Time) error {
+	_, err := r.idb().NewUpdate().
+		Model((*VideoRecord)(nil)).
+		Set("status = ?", status).
+		Set("updated_at = ?", updatedAt).
+		Where("source_id = ?", sourceID).
+		Exec(ctx)
+	return err
+}
+
+func (r *bunRepository) CountChatRecordsBefore(ctx context.Context, sourceID string, before time.Time) (int, error) {
+	return r.idb().NewSelect().
+		Model((*ChatRecord)(nil)).
+		Where("source_id = ?", sourceID).
+		Where("published_at < ?", before).
+		Count(ctx)
+}
+
+func (r *bunRepository) GetChatRecordsBefore(ctx context.Context, sourceID string, before time.Time, limit int) ([]ChatRecord, error) {
+	records := make([]ChatRecord, 0)
+	err := r.idb().NewSelect().
+		Model(&records).
+		Where("source_id = ?", sourceID).
+		Where("published_at < ?", before).
+		Order("published_at ASC").
+		Limit(limit).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *bunRepository) DeleteChatRecords(ctx context.Context, records []ChatRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	_, err := r.idb().NewDelete().
+		Model(&records).
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *bunRepository) InsertChatArchiveRecord(ctx context.Context, record *ChatArchiveRecord) error {
+	_, err := r.idb().NewInsert().Model(record).Returning("id").Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *bunRepository) ListChatRecords(ctx context.Context, query ChatQuery) ([]ChatRecord, error) {
+	records := make([]ChatRecord, 0)
+	q := r.idb().NewSelect().Model(&records)
+	if len(query.SourceIDs) != 0 {
+		q = q.Where("source_id IN (?)", bun.In(query.SourceIDs))
+	}
+	if !query.From.IsZero() {
+		q = q.Where("published_at >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		q = q.Where("published_at < ?", query.To)
+	}
+	if query.Author != "" {
+		q = q.Where("author_channel_id = ?", query.Author)
+	}
+	if query.IsNegative != nil {
+		q = q.Where("is_negative = ?", *query.IsNegative)
+	}
+	if query.MessageType != "" {
+		q = q.Where("message_type = ?", query.MessageType)
+	}
+	// The ID is the primary key, so it breaks the ties of publishedAt
+	if query.After != nil {
+		q = q.Where("(published_at > ? OR (published_at = ? AND id > ?))", query.After.PublishedAt, query.After.PublishedAt, query.After.ID)
+	}
+	err := q.Order("published_at ASC", "id ASC").Limit(query.Limit).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *bunRepository) GetChatRecordByID(ctx context.Context, id string) (ChatRecord, error) {
+	var record ChatRecord
+	err := r.idb().NewSelect().
+		Model(&record).
+		Where("id = ?", id).
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return ChatRecord{}, err
+	}
+
+	return record, nil
+}
+
+func (r *bunRepository) InsertOutboxRecords(ctx context.Context, records []OutboxRecord) error {
+	_, err := r.idb().NewInsert().Model(&records).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *bunRepository) ListPendingOutboxRecords(ctx context.Context, limit int) ([]OutboxRecord, error) {
+	// The limit is applied to each queue so that a long queue does not starve the later queues
+	queues := r.idb().NewSelect().
+		Model((*OutboxRecord)(nil)).
+		ColumnExpr("*").
+		ColumnExpr("ROW_NUMBER() OVER (PARTITION BY sink, source_id ORDER BY id) AS queue_position").
+		Where("status = ?", OutboxStatusPending)
+
+	records := make([]OutboxRecord, 0)
+	err := r.idb().NewSelect().
+		Model(&records).
+		ModelTableExpr("(?) AS outbox_record", queues).
+		Where("queue_position <= ?", limit).
+		Order("sink ASC", "source_id ASC", "id ASC").
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (r *bunRepository) UpdateOutboxRecord(ctx context.Context, record OutboxRecord) error {
+	_, err := r.idb().NewUpdate().
+		Model(&record).
+		Column("status", "attempts", "last_error", "next_attempt_at", "delivered_at").
+		WherePK().
+		Exec(ctx)
 	if err != nil {
 		return err
 	}
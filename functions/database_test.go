@@ -0,0 +1,91 @@
+package functions
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListChatRecordsKeyedByID(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	// The same message sent twice at the same time is saved as two chats
+	err := repo.InsertChatRecord(ctx, []ChatRecord{
+		{ID: "c", Message: "hello", SourceID: "s", PublishedAt: now},
+		{ID: "a", Message: "hello", SourceID: "s", PublishedAt: now},
+		{ID: "b", Message: "bye", SourceID: "s", PublishedAt: now.Add(-time.Second)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	var after *ChatKey
+	for {
+		records, err := repo.ListChatRecords(ctx, ChatQuery{SourceIDs: []string{"s"}, After: after, Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 0 {
+			break
+		}
+		ids = append(ids, records[0].ID)
+		after = &ChatKey{PublishedAt: records[0].PublishedAt, ID: records[0].ID}
+	}
+
+	want := []string{"b", "a", "c"}
+	if len(ids) != len(want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("ids = %v, want %v", ids, want)
+		}
+	}
+
+	// A chat is deleted by its ID without the other chats of the same message
+	if err := repo.DeleteChatRecords(ctx, []ChatRecord{{ID: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetChatRecordByID(ctx, "c"); err != nil {
+		t.Errorf("chat c: %v", err)
+	}
+}
+
+func TestListPendingOutboxRecordsLimitsEachQueue(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	batch := func(sink, sourceID, batchID, status string) OutboxRecord {
+		return OutboxRecord{Sink: sink, SourceID: sourceID, BatchID: batchID, Status: status, CreatedAt: now, NextAttemptAt: now}
+	}
+	// The long queue of a is inserted first
+	err := repo.InsertOutboxRecords(ctx, []OutboxRecord{
+		batch("webhook", "a", "a0", OutboxStatusDelivered),
+		batch("webhook", "a", "a1", OutboxStatusPending),
+		batch("webhook", "a", "a2", OutboxStatusPending),
+		batch("webhook", "a", "a3", OutboxStatusPending),
+		batch("webhook", "b", "b1", OutboxStatusPending),
+		batch("pubsub", "a", "p1", OutboxStatusPending),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := repo.ListPendingOutboxRecords(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, record := range records {
+		got = append(got, record.BatchID)
+	}
+	want := []string{"p1", "a1", "a2", "b1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("batches = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,210 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/KasumiMercury/patotta-stone-function-chat/signature"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// retryableStatuses are the statuses of the external service worth retrying
+var retryableStatuses = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooEarly,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// DeliveryError is the error of a batch that the external service did not accept
+type DeliveryError struct {
+	BatchID    string
+	StatusCode int
+	Attempts   int
+	Err        error
+}
+
+func (e *DeliveryError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("deliver batch %s: status %d after %d attempts", e.BatchID, e.StatusCode, e.Attempts)
+	}
+	return fmt.Sprintf("deliver batch %s: %v after %d attempts", e.BatchID, e.Err, e.Attempts)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// DeliveryClient posts batches of chats to the external service.
+// A batch is retried with exponential backoff on the network errors and the retryable statuses.
+// Every attempt of a batch carries the same Idempotency-Key header, so the receiver can drop the duplicates.
+type DeliveryClient struct {
+	URL        string
+	HTTPClient *http.Client
+	// MaxRetries is the number of the retries after the first attempt
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Signer signs every attempt so that the external service can authenticate the requests (nil disables it)
+	Signer *signature.Signer
+}
+
+// DeliveryClientFromEnv reads EXTERNAL_SERVICE_URL and the optional settings:
+// EXTERNAL_SERVICE_TIMEOUT (timeout of each attempt, default 10s), EXTERNAL_SERVICE_MAX_RETRIES (default 3)
+// and SIGNING_KEYS ("id1:secret1,id2:secret2"; the first key signs the requests).
+// It returns nil if EXTERNAL_SERVICE_URL is not set.
+func DeliveryClientFromEnv() (*DeliveryClient, error) {
+	serviceUrl := os.Getenv("EXTERNAL_SERVICE_URL")
+	if serviceUrl == "" {
+		return nil, nil
+	}
+
+	timeout, err := getDurationEnv("EXTERNAL_SERVICE_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	maxRetries := 3
+	if os.Getenv("EXTERNAL_SERVICE_MAX_RETRIES") != "" {
+		if maxRetries, err = getIntEnv("EXTERNAL_SERVICE_MAX_RETRIES"); err != nil {
+			return nil, err
+		}
+	}
+
+	client := NewDeliveryClient(serviceUrl, timeout, maxRetries)
+	if client.Signer, err = signerFromEnv(); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// signerFromEnv returns the signer of the first key of SIGNING_KEYS, or nil if it is not set
+func signerFromEnv() (*signature.Signer, error) {
+	value := os.Getenv("SIGNING_KEYS")
+	if value == "" {
+		return nil, nil
+	}
+	keys, err := signature.ParseKeys(value)
+	if err != nil {
+		return nil, err
+	}
+	return signature.NewSigner(keys[0]), nil
+}
+
+func NewDeliveryClient(serviceUrl string, timeout time.Duration, maxRetries int) *DeliveryClient {
+	return &DeliveryClient{
+		URL: serviceUrl,
+		HTTPClient: &http.Client{
+			Timeout: timeout,
+			// The trace context is propagated to the external service
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+		},
+		MaxRetries: maxRetries,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+	}
+}
+
+// Deliver posts the body as the batch of batchID
+func (c *DeliveryClient) Deliver(ctx context.Context, batchID string, contentType string, body []byte) error {
+	ctx, span := otel.Tracer("functions").Start(ctx, "deliver", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("delivery.batch_id", batchID),
+		attribute.Int("delivery.size", len(body)),
+	)
+
+	backoff := c.MinBackoff
+	for attempt := 1; ; attempt++ {
+		status, retryAfter, err := c.post(ctx, batchID, contentType, body)
+		if err == nil {
+			span.SetAttributes(attribute.Int("delivery.attempts", attempt))
+			return nil
+		}
+		span.AddEvent("delivery failed", trace.WithAttributes(
+			attribute.Int("delivery.attempt", attempt),
+			attribute.Int("http.status_code", status),
+			attribute.String("error", err.Error()),
+		))
+
+		retryable := status == 0 || slices.Contains(retryableStatuses, status)
+		if !retryable || attempt > c.MaxRetries || ctx.Err() != nil {
+			derr := &DeliveryError{BatchID: batchID, StatusCode: status, Attempts: attempt, Err: err}
+			span.RecordError(derr)
+			span.SetStatus(codes.Error, derr.Error())
+			return derr
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		wait = min(wait, c.MaxBackoff)
+		slog.Warn("Retry delivery to external service",
+			slog.Group("externalService", "batchId", batchID, "attempt", attempt, "status", status, "wait", wait, "error", err),
+		)
+		select {
+		case <-ctx.Done():
+			derr := &DeliveryError{BatchID: batchID, StatusCode: status, Attempts: attempt, Err: ctx.Err()}
+			span.RecordError(derr)
+			span.SetStatus(codes.Error, derr.Error())
+			return derr
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, c.MaxBackoff)
+	}
+}
+
+// post makes an attempt and returns the status (0 for a network error) and the wait requested by Retry-After
+func (c *DeliveryClient) post(ctx context.Context, batchID string, contentType string, body []byte) (int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Idempotency-Key", batchID)
+	// Each attempt is signed with a fresh timestamp
+	if c.Signer != nil {
+		c.Signer.SignHeader(req.Header, body)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func(resp *http.Response) {
+		// Drain the body so that the connection is reused
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("failed to close response body", "error", err)
+		}
+	}(resp)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, 0, nil
+	}
+
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return resp.StatusCode, retryAfter, errors.New(resp.Status)
+}
@@ -0,0 +1,211 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deliveryServer answers the attempts with the statuses in order (200 after them), and records them
+type deliveryServer struct {
+	statuses []int
+	// retryAfter is the Retry-After header sent with the failed statuses
+	retryAfter string
+	// delay is the time the first attempt takes
+	delay time.Duration
+
+	mu       sync.Mutex
+	attempts []*http.Request
+	at       []time.Time
+}
+
+func (s *deliveryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	n := len(s.attempts)
+	s.attempts = append(s.attempts, r)
+	s.at = append(s.at, time.Now())
+	s.mu.Unlock()
+
+	if n == 0 && s.delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(s.delay):
+		}
+	}
+	status := http.StatusOK
+	if n < len(s.statuses) {
+		status = s.statuses[n]
+	}
+	if status >= 300 && s.retryAfter != "" {
+		w.Header().Set("Retry-After", s.retryAfter)
+	}
+	w.WriteHeader(status)
+}
+
+func (s *deliveryServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.attempts)
+}
+
+// newTestDeliveryClient returns the client of srv with short backoffs
+func newTestDeliveryClient(srv *httptest.Server, timeout time.Duration, maxRetries int) *DeliveryClient {
+	client := NewDeliveryClient(srv.URL, timeout, maxRetries)
+	client.MinBackoff = time.Millisecond
+	client.MaxBackoff = 10 * time.Millisecond
+	return client
+}
+
+func TestDeliveryClientRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		maxRetries   int
+		wantAttempts int
+		wantStatus   int
+	}{
+		{name: "success", statuses: nil, maxRetries: 3, wantAttempts: 1},
+		{name: "retry 5xx", statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}, maxRetries: 3, wantAttempts: 4},
+		{name: "retry 429", statuses: []int{http.StatusTooManyRequests}, maxRetries: 3, wantAttempts: 2},
+		{name: "give up after retries", statuses: []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}, maxRetries: 2, wantAttempts: 3, wantStatus: http.StatusInternalServerError},
+		{name: "no retry on 400", statuses: []int{http.StatusBadRequest}, maxRetries: 3, wantAttempts: 1, wantStatus: http.StatusBadRequest},
+		{name: "no retry on 401", statuses: []int{http.StatusUnauthorized}, maxRetries: 3, wantAttempts: 1, wantStatus: http.StatusUnauthorized},
+		{name: "no retry on 409", statuses: []int{http.StatusConflict}, maxRetries: 3, wantAttempts: 1, wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &deliveryServer{statuses: tt.statuses}
+			srv := httptest.NewServer(server)
+			defer srv.Close()
+
+			err := newTestDeliveryClient(srv, time.Second, tt.maxRetries).Deliver(context.Background(), "batch-1", "application/json", []byte(`{"chats":[]}`))
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				var derr *DeliveryError
+				if !errors.As(err, &derr) {
+					t.Fatalf("err = %v, want DeliveryError", err)
+				}
+				if derr.StatusCode != tt.wantStatus || derr.Attempts != tt.wantAttempts || derr.BatchID != "batch-1" {
+					t.Errorf("err = %+v, want status %d after %d attempts", derr, tt.wantStatus, tt.wantAttempts)
+				}
+			}
+			if got := server.count(); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+
+			// Every attempt carries the same key
+			for i, r := range server.attempts {
+				if key := r.Header.Get("Idempotency-Key"); key != "batch-1" {
+					t.Errorf("attempt %d: Idempotency-Key = %q, want batch-1", i+1, key)
+				}
+				if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+					t.Errorf("attempt %d: Content-Type = %q", i+1, ct)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliveryClientRetryAfter(t *testing.T) {
+	server := &deliveryServer{statuses: []int{http.StatusServiceUnavailable}, retryAfter: "1"}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	client := newTestDeliveryClient(srv, time.Second, 3)
+	client.MaxBackoff = 5 * time.Second
+
+	if err := client.Deliver(context.Background(), "batch-1", "application/json", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.at) != 2 {
+		t.Fatalf("attempts = %d, want 2", len(server.at))
+	}
+	// The backoff of 1ms is replaced by the second requested by the service
+	if wait := server.at[1].Sub(server.at[0]); wait < time.Second {
+		t.Errorf("wait = %v, want at least 1s", wait)
+	}
+}
+
+func TestDeliveryClientRetryAfterIsCapped(t *testing.T) {
+	server := &deliveryServer{statuses: []int{http.StatusTooManyRequests}, retryAfter: strconv.Itoa(3600)}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	// MaxBackoff caps the wait requested by the service
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := newTestDeliveryClient(srv, time.Second, 3).Deliver(ctx, "batch-1", "application/json", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.count(); got != 2 {
+		t.Errorf("attempts = %d, want 2", got)
+	}
+}
+
+func TestDeliveryClientAttemptTimeout(t *testing.T) {
+	t.Run("retry after timeout", func(t *testing.T) {
+		server := &deliveryServer{delay: 5 * time.Second}
+		srv := httptest.NewServer(server)
+		defer srv.Close()
+
+		// The first attempt times out, and the retry succeeds
+		start := time.Now()
+		if err := newTestDeliveryClient(srv, 100*time.Millisecond, 3).Deliver(context.Background(), "batch-1", "application/json", nil); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("elapsed = %v, want the first attempt to time out", elapsed)
+		}
+		if got := server.count(); got != 2 {
+			t.Errorf("attempts = %d, want 2", got)
+		}
+	})
+
+	t.Run("every attempt times out", func(t *testing.T) {
+		block := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-block:
+			}
+		}))
+		defer srv.Close()
+		defer close(block)
+
+		err := newTestDeliveryClient(srv, 50*time.Millisecond, 2).Deliver(context.Background(), "batch-1", "application/json", nil)
+		var derr *DeliveryError
+		if !errors.As(err, &derr) {
+			t.Fatalf("err = %v, want DeliveryError", err)
+		}
+		// A timeout has no status, and is retried like the network errors
+		if derr.StatusCode != 0 || derr.Attempts != 3 || derr.Err == nil {
+			t.Errorf("err = %+v, want a timeout after 3 attempts", derr)
+		}
+	})
+}
+
+func TestDeliveryClientStopsOnCanceledContext(t *testing.T) {
+	server := &deliveryServer{statuses: []int{http.StatusServiceUnavailable}, retryAfter: "60"}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	client := newTestDeliveryClient(srv, time.Second, 10)
+	client.MaxBackoff = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := client.Deliver(ctx, "batch-1", "application/json", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the deadline of the context", err)
+	}
+	if got := server.count(); got != 1 {
+		t.Errorf("attempts = %d, want 1", got)
+	}
+}
@@ -0,0 +1,78 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"log/slog"
+	"net/http"
+)
+
+// MessagePublishedData is the data of the CloudEvent google.cloud.pubsub.topic.v1.messagePublished
+type MessagePublishedData struct {
+	Message      PubSubMessage `json:"message"`
+	Subscription string        `json:"subscription"`
+}
+
+type PubSubMessage struct {
+	// Data is RunOptions in JSON, or empty for the default options
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+	MessageID  string            `json:"messageId"`
+}
+
+// chatEvent is the entry point triggered by a Pub/Sub message, e.g. published by Cloud Scheduler.
+// It runs the same pipeline as chatWatcher with the options in the message.
+func chatEvent(ctx context.Context, e event.Event) error {
+	// Set custom logger
+	logger := NewCustomLogger(ctx)
+	slog.SetDefault(logger)
+
+	cfg := loadWatchConfig()
+
+	var data MessagePublishedData
+	if err := e.DataAs(&data); err != nil {
+		// The malformed event is acknowledged because the redelivery fails the same way
+		slog.Error("Failed to decode event",
+			slog.Group("chatEvent", "eventId", e.ID(), "type", e.Type(), "error", err),
+		)
+		return nil
+	}
+	options, err := decodeRunOptions(data.Message.Data)
+	if err != nil {
+		slog.Error("Invalid options in message",
+			slog.Group("chatEvent", "messageId", data.Message.MessageID, "error", err),
+		)
+		return nil
+	}
+
+	// The error makes Pub/Sub redeliver the message by the retry policy of the subscription.
+	// The partial failure is not redelivered, like the status 207 of chatWatcher.
+	run, err := runChatWatcher(ctx, cfg, options)
+	if err != nil {
+		return err
+	}
+	if run.StatusCode(nil) == http.StatusInternalServerError {
+		return fmt.Errorf("all videos failed: %v", run.Errors)
+	}
+
+	slog.Info("chatEvent", slog.Group("chatEvent", "messageId", data.Message.MessageID, "errors", len(run.Errors)))
+	return nil
+}
+
+// decodeRunOptions decodes the options in JSON, where the span defaults to 60 minutes like the HTTP query.
+// The overrides are accepted because only the principals granted by IAM can publish to the topic.
+func decodeRunOptions(b []byte) (RunOptions, error) {
+	options := RunOptions{Span: 60}
+	if len(b) == 0 {
+		return options, nil
+	}
+	if err := json.Unmarshal(b, &options); err != nil {
+		return RunOptions{}, err
+	}
+	if err := options.validate(); err != nil {
+		return RunOptions{}, err
+	}
+	return options, nil
+}
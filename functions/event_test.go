@@ -0,0 +1,140 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"testing"
+)
+
+// newPubSubEvent wraps the data in the CloudEvent of a Pub/Sub message as Eventarc delivers it
+func newPubSubEvent(t *testing.T, data string) event.Event {
+	t.Helper()
+	e := event.New()
+	e.SetID("event-1")
+	e.SetType("google.cloud.pubsub.topic.v1.messagePublished")
+	e.SetSource("//pubsub.googleapis.com/projects/project/topics/chat")
+	if err := e.SetData(event.ApplicationJSON, json.RawMessage(data)); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestDecodeRunOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    RunOptions
+		wantErr bool
+	}{
+		{name: "empty", data: "", want: RunOptions{Span: 60}},
+		{name: "default span", data: `{"dryRun":true}`, want: RunOptions{Span: 60, DryRun: true}},
+		{name: "span", data: `{"span":30,"mode":"live"}`, want: RunOptions{Span: 30, Mode: RunModeLive}},
+		{name: "not JSON", data: "span=30", wantErr: true},
+		{name: "span out of range", data: `{"span":-1}`, wantErr: true},
+		{name: "unknown mode", data: `{"mode":"archive"}`, wantErr: true},
+		{name: "skipSentiment without dryRun", data: `{"skipSentiment":true}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeRunOptions([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("options = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Span != tt.want.Span || got.Mode != tt.want.Mode || got.DryRun != tt.want.DryRun {
+				t.Errorf("options = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessagePublishedDataDecodesEnvelope(t *testing.T) {
+	// The data of the message is base64 in the envelope
+	e := newPubSubEvent(t, `{
+		"message": {"data": "eyJzcGFuIjozMH0=", "attributes": {"origin": "scheduler"}, "messageId": "message-1"},
+		"subscription": "projects/project/subscriptions/chat"
+	}`)
+
+	var data MessagePublishedData
+	if err := e.DataAs(&data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Message.MessageID != "message-1" || data.Message.Attributes["origin"] != "scheduler" || data.Subscription != "projects/project/subscriptions/chat" {
+		t.Errorf("data = %+v", data)
+	}
+	options, err := decodeRunOptions(data.Message.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Span != 30 {
+		t.Errorf("span = %d, want 30", options.Span)
+	}
+}
+
+func TestChatEvent(t *testing.T) {
+	t.Setenv("LOCAL_ONLY", "true")
+	t.Setenv("YOUTUBE_API_KEY", "key")
+	t.Setenv("DSN", "file::memory:")
+	t.Setenv("TARGET_CHANNEL_ID", "target")
+	t.Setenv("STATIC_TARGET", `{"sourceId":"static","chatId":"chat-static"}`)
+	ctx := context.Background()
+
+	repo := newTestRepository(t)
+	useTestRepository(t, repo)
+	source := NewFakeChatSource()
+	useTestChatSource(t, source)
+	runs := func(t *testing.T) []RunRecord {
+		t.Helper()
+		records, err := repo.ListRunRecords(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+
+	// The malformed messages are acknowledged without a run, since the redelivery would fail forever
+	t.Run("malformed", func(t *testing.T) {
+		for name, data := range map[string]string{
+			"envelope not JSON": `"message"`,
+			"data not base64":   `{"message": {"data": "not base64!", "messageId": "message-1"}}`,
+			"options not JSON":  `{"message": {"data": "c3Bhbj0zMA==", "messageId": "message-1"}}`,
+			"options not valid": `{"message": {"data": "eyJzcGFuIjotMX0=", "messageId": "message-1"}}`,
+		} {
+			if err := chatEvent(ctx, newPubSubEvent(t, data)); err != nil {
+				t.Errorf("%s: err = %v, want the message acknowledged", name, err)
+			}
+		}
+		if records := runs(t); len(records) != 0 {
+			t.Errorf("runs = %d, want 0", len(records))
+		}
+	})
+
+	// {"span":30,"target":{"sourceId":"video","chatId":"chat-video"}}
+	target := `{"message": {"data": "eyJzcGFuIjozMCwidGFyZ2V0Ijp7InNvdXJjZUlkIjoidmlkZW8iLCJjaGF0SWQiOiJjaGF0LXZpZGVvIn19", "messageId": "message-2"}}`
+
+	t.Run("run", func(t *testing.T) {
+		if err := chatEvent(ctx, newPubSubEvent(t, target)); err != nil {
+			t.Fatal(err)
+		}
+		records := runs(t)
+		if len(records) != 1 || records[0].Span != 30 || len(records[0].VideoIDs) != 1 || records[0].VideoIDs[0] != "video" {
+			t.Errorf("runs = %+v, want a run of the target with span 30", records)
+		}
+	})
+
+	// The run without any successful video is redelivered
+	t.Run("failed run", func(t *testing.T) {
+		source.Err = errors.New("quota exceeded")
+		defer func() { source.Err = nil }()
+		if err := chatEvent(ctx, newPubSubEvent(t, target)); err == nil {
+			t.Error("err = nil, want the message redelivered")
+		}
+	})
+}
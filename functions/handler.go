@@ -2,7 +2,9 @@ package functions
 
 import (
 	"context"
+	"github.com/cloudevents/sdk-go/v2/event"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
 	"log/slog"
@@ -42,3 +44,30 @@ func InstrumentedHandler(name string, function HttpHandler, flusher Flush) HttpH
 		}
 	}
 }
+
+type EventHandler func(context.Context, event.Event) error
+
+// InstrumentedEventHandler traces the function triggered by a Pub/Sub message like InstrumentedHandler
+func InstrumentedEventHandler(name string, function EventHandler, flusher Flush) EventHandler {
+	return func(ctx context.Context, e event.Event) error {
+		ctx, span := otel.Tracer("functions").Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(semconv.FaaSTriggerPubsub, semconv.FaaSExecutionKey.String(e.ID())),
+		)
+		err := function(ctx, e)
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+
+		// force flush the span data
+		if err := flusher.ForceFlush(ctx); err != nil {
+			slog.Error(
+				"Failed to flush spans",
+				slog.Group("tracing", slog.Group("forceFlush", "error", err)),
+			)
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,64 @@
+package functions
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestRepository opens a SQLite repository in the temporary directory of the test
+func newTestRepository(t *testing.T) *SQLiteRepository {
+	t.Helper()
+	repo, err := NewSQLiteRepository(context.Background(), "file:"+t.TempDir()+"/chat.db", DBConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = repo.Close() })
+	return repo
+}
+
+// useTestRepository makes getChatRepository return repo in the test
+func useTestRepository(t *testing.T, repo ChatRepository) {
+	t.Helper()
+	repoClient.mu.Lock()
+	repoClient.value, repoClient.ready = repo, true
+	repoClient.mu.Unlock()
+	t.Cleanup(func() {
+		repoClient.mu.Lock()
+		repoClient.value, repoClient.ready = nil, false
+		repoClient.mu.Unlock()
+	})
+}
+
+// useTestChatSource makes getChatSource return source in the test
+func useTestChatSource(t *testing.T, source ChatSource) {
+	t.Helper()
+	sourceClient.mu.Lock()
+	sourceClient.value, sourceClient.ready = source, true
+	sourceClient.mu.Unlock()
+	t.Cleanup(func() {
+		sourceClient.mu.Lock()
+		sourceClient.value, sourceClient.ready = nil, false
+		sourceClient.mu.Unlock()
+	})
+}
+
+// insertVideos saves the video records
+func insertVideos(t *testing.T, repo *SQLiteRepository, videos ...VideoRecord) {
+	t.Helper()
+	if _, err := repo.db.NewInsert().Model(&videos).Exec(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,195 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// The messages exchanged over the WebSocket of Hub.
+// A client sends "subscribe" and "unsubscribe" with sourceIds to choose the videos,
+// and "filter" with authorClass to choose the author class ("" for all).
+// The server replies "subscribed" with the current settings for each of them,
+// and sends "chat" for each chat, "overflow" when chats were lost because the client was too slow,
+// and "error" for an invalid message.
+const (
+	hubMessageSubscribe   = "subscribe"
+	hubMessageUnsubscribe = "unsubscribe"
+	hubMessageFilter      = "filter"
+	hubMessageSubscribed  = "subscribed"
+	hubMessageChat        = "chat"
+	hubMessageOverflow    = "overflow"
+	hubMessageError       = "error"
+)
+
+type hubMessage struct {
+	Type        string     `json:"type"`
+	SourceIDs   []string   `json:"sourceIds,omitempty"`
+	AuthorClass string     `json:"authorClass,omitempty"`
+	Chat        *ChatEvent `json:"chat,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// Hub serves the chats published to the broker over WebSocket.
+// Each connection subscribes to the broker only while it has at least one video.
+// A connection too slow to receive the chats loses them and gets "overflow",
+// so that it can catch up with the chats function if necessary.
+type Hub struct {
+	broker *Broker
+
+	// AllowedOrigins is the origins allowed to connect (empty allows all)
+	AllowedOrigins []string
+	// WriteTimeout closes the connection that does not accept a message in time
+	WriteTimeout time.Duration
+}
+
+func NewHub(broker *Broker) *Hub {
+	return &Hub{
+		broker:       broker,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+func (h *Hub) Handler() http.Handler {
+	return websocket.Server{
+		Handshake: h.handshake,
+		Handler:   h.serve,
+	}
+}
+
+func (h *Hub) handshake(config *websocket.Config, r *http.Request) error {
+	if len(h.AllowedOrigins) == 0 {
+		return nil
+	}
+	origin := r.Header.Get("Origin")
+	if !slices.Contains(h.AllowedOrigins, origin) {
+		return fmt.Errorf("origin not allowed: %s", origin)
+	}
+	return nil
+}
+
+// hubConn is the state of a connection owned by the goroutine of serve
+type hubConn struct {
+	ws     *websocket.Conn
+	filter ChatFilter
+	sub    *Subscription
+}
+
+func (h *Hub) serve(ws *websocket.Conn) {
+	defer ws.Close()
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+
+	conn := &hubConn{ws: ws}
+	defer conn.unsubscribe()
+
+	// The messages from the client are received by another goroutine
+	// so that the chats are sent while waiting for them
+	messages := make(chan hubMessage)
+	go func() {
+		defer close(messages)
+		for {
+			var msg hubMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		var events <-chan ChatEvent
+		if conn.sub != nil {
+			events = conn.sub.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			if err := h.send(conn, h.handle(conn, msg)); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				if !conn.sub.Dropped() {
+					return
+				}
+				slog.Info("Dropped slow WebSocket client", slog.Group("hub", "remoteAddr", ws.Request().RemoteAddr))
+				// Resubscribe and tell the client that chats were lost
+				conn.sub = h.broker.Subscribe(conn.filter)
+				if err := h.send(conn, hubMessage{Type: hubMessageOverflow}); err != nil {
+					return
+				}
+				continue
+			}
+			if err := h.send(conn, hubMessage{Type: hubMessageChat, Chat: &event}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle applies the message of the client and returns the reply
+func (h *Hub) handle(conn *hubConn, msg hubMessage) hubMessage {
+	switch msg.Type {
+	case hubMessageSubscribe:
+		for _, id := range msg.SourceIDs {
+			if !slices.Contains(conn.filter.SourceIDs, id) {
+				conn.filter.SourceIDs = append(conn.filter.SourceIDs, id)
+			}
+		}
+	case hubMessageUnsubscribe:
+		conn.filter.SourceIDs = slices.DeleteFunc(conn.filter.SourceIDs, func(id string) bool {
+			return slices.Contains(msg.SourceIDs, id)
+		})
+	case hubMessageFilter:
+		if msg.AuthorClass != "" && msg.AuthorClass != AuthorClassTarget && msg.AuthorClass != AuthorClassOther {
+			return hubMessage{Type: hubMessageError, Error: fmt.Sprintf("invalid authorClass: %s", msg.AuthorClass)}
+		}
+		conn.filter.AuthorClass = msg.AuthorClass
+	default:
+		return hubMessage{Type: hubMessageError, Error: fmt.Sprintf("unknown type: %s", msg.Type)}
+	}
+
+	// An empty filter matches all the videos, so the connection without videos does not subscribe
+	switch {
+	case len(conn.filter.SourceIDs) == 0:
+		conn.unsubscribe()
+	case conn.sub == nil:
+		conn.sub = h.broker.Subscribe(conn.filter)
+	default:
+		conn.sub.SetFilter(conn.filter)
+	}
+
+	return hubMessage{
+		Type:        hubMessageSubscribed,
+		SourceIDs:   conn.filter.SourceIDs,
+		AuthorClass: conn.filter.AuthorClass,
+	}
+}
+
+func (h *Hub) send(conn *hubConn, msg hubMessage) error {
+	if err := conn.ws.SetWriteDeadline(time.Now().Add(h.WriteTimeout)); err != nil {
+		return err
+	}
+	return websocket.JSON.Send(conn.ws, msg)
+}
+
+func (c *hubConn) unsubscribe() {
+	if c.sub != nil {
+		c.sub.Close()
+		c.sub = nil
+	}
+}
@@ -0,0 +1,148 @@
+package functions
+
+import (
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialHub connects to the hub served by srv
+func dialHub(t *testing.T, srv *httptest.Server, origin string) *websocket.Conn {
+	t.Helper()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func sendHub(t *testing.T, ws *websocket.Conn, msg hubMessage) {
+	t.Helper()
+	if err := websocket.JSON.Send(ws, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receiveHub(t *testing.T, ws *websocket.Conn) hubMessage {
+	t.Helper()
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var msg hubMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// expectSubscribed sends the message and checks the settings in the reply
+func expectSubscribed(t *testing.T, ws *websocket.Conn, msg hubMessage, sourceIDs []string, class string) {
+	t.Helper()
+	sendHub(t, ws, msg)
+	reply := receiveHub(t, ws)
+	if reply.Type != hubMessageSubscribed || !slices.Equal(reply.SourceIDs, sourceIDs) || reply.AuthorClass != class {
+		t.Fatalf("reply to %+v = %+v, want subscribed to %v with %q", msg, reply, sourceIDs, class)
+	}
+}
+
+// expectChat checks that the next message is the chat of the ID
+func expectChat(t *testing.T, ws *websocket.Conn, id string) {
+	t.Helper()
+	msg := receiveHub(t, ws)
+	if msg.Type != hubMessageChat || msg.Chat == nil || msg.Chat.ID != id {
+		t.Fatalf("message = %+v, want chat %s", msg, id)
+	}
+}
+
+func TestHubSubscribeAndFilter(t *testing.T) {
+	broker := NewBroker()
+	srv := httptest.NewServer(NewHub(broker).Handler())
+	defer srv.Close()
+	ws := dialHub(t, srv, "http://localhost")
+
+	// The subscription is made before the reply, so the chats published after it are delivered
+	expectSubscribed(t, ws, hubMessage{Type: hubMessageSubscribe, SourceIDs: []string{"a", "b"}}, []string{"a", "b"}, "")
+	broker.Publish(testEvent("a1", "a", AuthorClassTarget), testEvent("c1", "c", AuthorClassTarget), testEvent("b1", "b", AuthorClassOther))
+	expectChat(t, ws, "a1")
+	expectChat(t, ws, "b1")
+
+	expectSubscribed(t, ws, hubMessage{Type: hubMessageFilter, AuthorClass: AuthorClassTarget}, []string{"a", "b"}, AuthorClassTarget)
+	broker.Publish(testEvent("b2", "b", AuthorClassOther), testEvent("b3", "b", AuthorClassTarget))
+	expectChat(t, ws, "b3")
+
+	expectSubscribed(t, ws, hubMessage{Type: hubMessageUnsubscribe, SourceIDs: []string{"b"}}, []string{"a"}, AuthorClassTarget)
+	broker.Publish(testEvent("b4", "b", AuthorClassTarget), testEvent("a2", "a", AuthorClassTarget))
+	expectChat(t, ws, "a2")
+
+	// Without videos the connection receives nothing, as the empty filter would match all the chats
+	expectSubscribed(t, ws, hubMessage{Type: hubMessageUnsubscribe, SourceIDs: []string{"a"}}, nil, AuthorClassTarget)
+	broker.Publish(testEvent("a3", "a", AuthorClassTarget), testEvent("c2", "c", AuthorClassTarget))
+	expectSubscribed(t, ws, hubMessage{Type: hubMessageSubscribe, SourceIDs: []string{"c"}}, []string{"c"}, AuthorClassTarget)
+	broker.Publish(testEvent("c3", "c", AuthorClassTarget))
+	expectChat(t, ws, "c3")
+}
+
+func TestHubRejectsInvalidMessages(t *testing.T) {
+	srv := httptest.NewServer(NewHub(NewBroker()).Handler())
+	defer srv.Close()
+	ws := dialHub(t, srv, "http://localhost")
+
+	for _, msg := range []hubMessage{
+		{Type: hubMessageFilter, AuthorClass: "moderator"},
+		{Type: "publish"},
+	} {
+		sendHub(t, ws, msg)
+		if reply := receiveHub(t, ws); reply.Type != hubMessageError || reply.Error == "" {
+			t.Errorf("reply to %+v = %+v, want error", msg, reply)
+		}
+	}
+	// The connection is still usable
+	expectSubscribed(t, ws, hubMessage{Type: hubMessageSubscribe, SourceIDs: []string{"a"}}, []string{"a"}, "")
+}
+
+func TestHubAllowedOrigins(t *testing.T) {
+	hub := NewHub(NewBroker())
+	hub.AllowedOrigins = []string{"https://example.com"}
+	srv := httptest.NewServer(hub.Handler())
+	defer srv.Close()
+
+	if ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", "https://evil.example.com"); err == nil {
+		ws.Close()
+		t.Error("connection from the origin not allowed is accepted")
+	}
+	ws := dialHub(t, srv, "https://example.com")
+	expectSubscribed(t, ws, hubMessage{Type: hubMessageSubscribe, SourceIDs: []string{"a"}}, []string{"a"}, "")
+}
+
+func TestHubOverflowResubscribes(t *testing.T) {
+	broker := NewBroker()
+	broker.BufferSize = 1
+	srv := httptest.NewServer(NewHub(broker).Handler())
+	defer srv.Close()
+	ws := dialHub(t, srv, "http://localhost")
+	expectSubscribed(t, ws, hubMessage{Type: hubMessageSubscribe, SourceIDs: []string{"a"}}, []string{"a"}, "")
+
+	// The hub cannot take the chats of one Publish faster than the broker, so the subscription is dropped
+	var events []ChatEvent
+	for i := 0; i < 100; i++ {
+		events = append(events, testEvent("burst", "a", AuthorClassTarget))
+	}
+	broker.Publish(events...)
+	for {
+		msg := receiveHub(t, ws)
+		if msg.Type == hubMessageOverflow {
+			break
+		}
+		if msg.Type != hubMessageChat {
+			t.Fatalf("message = %+v, want chat or overflow", msg)
+		}
+	}
+
+	// The client is resubscribed with the same filter before the overflow is sent
+	broker.Publish(testEvent("b1", "b", AuthorClassTarget), testEvent("a1", "a", AuthorClassTarget))
+	expectChat(t, ws, "a1")
+}
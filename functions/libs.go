@@ -1,9 +1,14 @@
 package functions
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"net/url"
+	"os"
 	"slices"
 	"strconv"
 	"time"
@@ -46,6 +51,163 @@ func getSpanQuery(u *url.URL) (int, error) {
 	return spanInt, nil
 }
 
+// maxOptionsBodySize is the maximum size of the options in the body of chatWatcher
+const maxOptionsBodySize = 64 << 10
+
+// getRunOptions reads the options of chatWatcher from the query:
+// span, dryRun, sourceId and chatId (the target), mode, author (repeatable) and skipSentiment.
+// The options in the JSON body of a POST request override the query.
+func getRunOptions(r *http.Request) (RunOptions, error) {
+	span, err := getSpanQuery(r.URL)
+	if err != nil {
+		return RunOptions{}, err
+	}
+	dryRun, err := getDryRunQuery(r.URL)
+	if err != nil {
+		return RunOptions{}, err
+	}
+	options := RunOptions{Span: span, DryRun: dryRun}
+
+	values := r.URL.Query()
+	if sourceID := values.Get("sourceId"); sourceID != "" {
+		options.Target = &VideoInfo{SourceID: sourceID, ChatID: values.Get("chatId")}
+	} else if values.Get("chatId") != "" {
+		return RunOptions{}, fmt.Errorf("chatId requires sourceId")
+	}
+	options.Mode = values.Get("mode")
+	options.Authors = values["author"]
+	if skip := values.Get("skipSentiment"); skip != "" {
+		if options.SkipSentiment, err = strconv.ParseBool(skip); err != nil {
+			return RunOptions{}, fmt.Errorf("invalid skipSentiment: %s", skip)
+		}
+	}
+
+	if r.Method == http.MethodPost && r.Body != nil {
+		dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxOptionsBodySize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&options); err != nil && !errors.Is(err, io.EOF) {
+			return RunOptions{}, fmt.Errorf("invalid body: %w", err)
+		}
+	}
+
+	if err := options.validate(); err != nil {
+		return RunOptions{}, err
+	}
+	return options, nil
+}
+
+// getDryRunQuery reads the query parameter named "dryRun", false by default
+func getDryRunQuery(u *url.URL) (bool, error) {
+	dryRun := u.Query().Get("dryRun")
+	if dryRun == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(dryRun)
+	if err != nil {
+		return false, fmt.Errorf("invalid dryRun: %s", dryRun)
+	}
+	return b, nil
+}
+
+func getPollIntervalEnv() time.Duration {
+	// Default value is 30 minutes
+	// Every upcoming video is polled at least once within the interval
+	defVal := 30 * time.Minute
+
+	// Get the value of the environment variable named "UPCOMING_POLL_INTERVAL"
+	// The value is a duration string such as "30m" or "1h"
+	interval := os.Getenv("UPCOMING_POLL_INTERVAL")
+	if interval == "" {
+		return defVal
+	}
+
+	d, err := time.ParseDuration(interval)
+	if err != nil || d <= 0 {
+		slog.Error("Failed to set poll interval because of invalid value",
+			slog.Group("scheduler", "interval", interval),
+		)
+		return defVal
+	}
+
+	return d
+}
+
+func getLockTTLEnv() time.Duration {
+	// Default value is 10 minutes, which is longer than the timeout of the function
+	// The lease of a crashed run expires after the TTL
+	defVal := 10 * time.Minute
+
+	ttl := os.Getenv("LOCK_TTL")
+	if ttl == "" {
+		return defVal
+	}
+
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		slog.Error("Failed to set lock TTL because of invalid value",
+			slog.Group("lease", "ttl", ttl),
+		)
+		return defVal
+	}
+
+	return d
+}
+
+func getLockWaitEnv() time.Duration {
+	// Default value is 0, which skips the video locked by another run without waiting
+	defVal := time.Duration(0)
+
+	wait := os.Getenv("LOCK_WAIT")
+	if wait == "" {
+		return defVal
+	}
+
+	d, err := time.ParseDuration(wait)
+	if err != nil || d < 0 {
+		slog.Error("Failed to set lock wait because of invalid value",
+			slog.Group("lease", "wait", wait),
+		)
+		return defVal
+	}
+
+	return d
+}
+
+func getIntEnv(key string) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid value of %s: %q", key, v)
+	}
+	return n, nil
+}
+
+func getDurationEnv(key string) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid value of %s: %q", key, v)
+	}
+	return d, nil
+}
+
+func isPollDue(poll PollRecord, now time.Time) bool {
+	// The chat that has never been polled is always due
+	// Otherwise, the chat is due after the polling interval requested by the API has elapsed
+	if poll.NextPollAt.IsZero() {
+		return true
+	}
+
+	return !now.Before(poll.NextPollAt)
+}
+
 func filterChatsByPublishedAt(chats []Chat, threshold int64) []Chat {
 	// Filter the chats by the threshold
 	// The chats are already sorted by the publishedAt in ascending order (constraint of the YouTube API)
@@ -93,9 +255,12 @@ func convertChatsToRecords(chats []Chat) []ChatRecord {
 	for _, chat := range chats {
 		// Convert the chat to the chat record
 		chatRecords = append(chatRecords, ChatRecord{
-			Message:     chat.Message,
-			SourceID:    chat.SourceID,
-			PublishedAt: time.Unix(chat.PublishedAtUnix, 0),
+			Message:         chat.Message,
+			ID:              chat.ID,
+			AuthorChannelID: chat.AuthorChannelID,
+			MessageType:     chat.MessageType,
+			SourceID:        chat.SourceID,
+			PublishedAt:     time.Unix(chat.PublishedAtUnix, 0),
 		})
 	}
 
@@ -67,10 +67,11 @@ func NewCustomLogger(ctx context.Context) *slog.Logger {
 		))
 
 	sc := trace.SpanContextFromContext(ctx)
-	if sc.IsValid() {
+	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	if sc.IsValid() && projectID != "" {
 		// Add trace ID to the logger
-		// Error handling when GOOGLE_CLOUD_PROJECT is undefined is already done in InitTracing()
-		traceString := fmt.Sprintf("projects/%s/traces/%s", os.Getenv("GOOGLE_CLOUD_PROJECT"), sc.TraceID().String())
+		// The traces are exported only with GOOGLE_CLOUD_PROJECT (see InitTracing)
+		traceString := fmt.Sprintf("projects/%s/traces/%s", projectID, sc.TraceID().String())
 		logger = logger.With(
 			slog.String("logging.googleapis.com/trace", traceString),
 			slog.String("logging.googleapis.com/spanId", sc.SpanID().String()),
@@ -6,8 +6,12 @@ import (
 )
 
 type Chat struct {
+	// ID is the ID of the message assigned by YouTube
+	ID              string
 	AuthorChannelID string
 	Message         string
+	// MessageType is the type of the message such as "textMessageEvent" or "superChatEvent"
+	MessageType     string
 	PublishedAtUnix int64
 	SourceID        string
 }
@@ -15,22 +19,133 @@ type Chat struct {
 type ChatRecord struct {
 	bun.BaseModel `bun:"table:chats"`
 
-	Message     string    `bun:",pk,type:varchar(255)"`
-	IsNegative  bool      `bun:",type:tinyint(1)"`
-	SourceID    string    `bun:",type:varchar(255)"`
-	PublishedAt time.Time `bun:",type:timestamp"`
+	// ID is the message ID assigned by YouTube, or the ID derived from the message for the chats saved before the IDs
+	ID              string    `bun:",pk,type:varchar(255)" json:"id"`
+	Message         string    `bun:",type:varchar(255)" json:"message"`
+	AuthorChannelID string    `bun:",type:varchar(255)" json:"authorChannelId"`
+	MessageType     string    `bun:",type:varchar(64)" json:"messageType"`
+	IsNegative      bool      `bun:",type:boolean" json:"isNegative"`
+	SourceID        string    `bun:",type:varchar(255)" json:"sourceId"`
+	PublishedAt     time.Time `bun:",type:timestamptz" json:"publishedAt"`
 }
 
+// ChatArchiveRecord is a batch of the chats moved out of the chats table by the purge
+type ChatArchiveRecord struct {
+	bun.BaseModel `bun:"table:chat_archives"`
+
+	ID               int64     `bun:",pk,autoincrement"`
+	SourceID         string    `bun:",type:varchar(255)"`
+	FirstPublishedAt time.Time `bun:",type:timestamptz"`
+	LastPublishedAt  time.Time `bun:",type:timestamptz"`
+	Count            int       `bun:",type:integer"`
+	ArchivedAt       time.Time `bun:",type:timestamptz"`
+	// Payload is the gzip-compressed JSON Lines of the chat records
+	Payload []byte `bun:",type:bytea"`
+}
+
+// VideoStatusClosed is the status of the video whose live chat went offline.
+// The watcher no longer polls the video, which is neither live nor upcoming.
+const VideoStatusClosed = "closed"
+
 type VideoRecord struct {
 	bun.BaseModel `bun:"table:videos"`
 
-	SourceID  string    `bun:",type:varchar(255)"`
-	Status    string    `bun:",type:varchar(255)"`
-	ChatID    string    `bun:",type:varchar(255)"`
-	UpdatedAt time.Time `bun:",type:timestamp"`
+	SourceID    string    `bun:",pk,type:varchar(255)"`
+	Status      string    `bun:",type:varchar(255)"`
+	ChatID      string    `bun:",type:varchar(255)"`
+	ScheduledAt time.Time `bun:",type:timestamptz,nullzero"`
+	UpdatedAt   time.Time `bun:",type:timestamptz"`
 }
 
-type VideoInfo struct {
+type PollRecord struct {
+	bun.BaseModel `bun:"table:polls"`
+
+	SourceID              string    `bun:",pk,type:varchar(255)"`
+	ChatID                string    `bun:",type:varchar(255)"`
+	LastPolledAt          time.Time `bun:",type:timestamptz"`
+	NextPollAt            time.Time `bun:",type:timestamptz,nullzero"`
+	PollingIntervalMillis int64     `bun:",type:bigint"`
+	OfflineAt             time.Time `bun:",type:timestamptz,nullzero"`
+}
+
+type LeaseRecord struct {
+	bun.BaseModel `bun:"table:leases"`
+
+	Name      string    `bun:",pk,type:varchar(255)"`
+	Holder    string    `bun:",type:varchar(64)"`
+	ExpiresAt time.Time `bun:",type:timestamptz"`
+}
+
+const (
+	OutboxStatusPending   = "pending"
+	OutboxStatusDelivered = "delivered"
+	// OutboxStatusDead is the batch given up after the maximum attempts
+	OutboxStatusDead = "dead"
+)
+
+// OutboxRecord is a batch of the chats waiting to be delivered to a sink
+type OutboxRecord struct {
+	bun.BaseModel `bun:"table:outbox"`
+
+	ID int64 `bun:",pk,autoincrement"`
+	// Sink is the name of the sink in SinkRegistry
+	Sink     string `bun:",type:varchar(64)"`
+	SourceID string `bun:",type:varchar(255)"`
+	// BatchID is the idempotency key of the delivery
+	BatchID       string    `bun:",type:varchar(64)"`
+	Payload       []byte    `bun:",type:bytea"`
+	Count         int       `bun:",type:integer"`
+	Status        string    `bun:",type:varchar(16)"`
+	Attempts      int       `bun:",type:integer"`
+	LastError     string    `bun:",type:text"`
+	CreatedAt     time.Time `bun:",type:timestamptz"`
+	NextAttemptAt time.Time `bun:",type:timestamptz"`
+	DeliveredAt   time.Time `bun:",type:timestamptz,nullzero"`
+}
+
+type RunRecord struct {
+	bun.BaseModel `bun:"table:runs"`
+
+	ID        int64     `bun:",pk,autoincrement" json:"id"`
+	StartedAt time.Time `bun:",type:timestamptz" json:"startedAt"`
+	EndedAt   time.Time `bun:",type:timestamptz" json:"endedAt"`
+	Span      int       `bun:",type:integer" json:"span"`
+	Mode      string    `bun:",type:varchar(16)" json:"mode"`
+	VideoIDs  []string  `bun:"video_ids,type:jsonb" json:"videoIds"`
+	// Fetched is the number of the chats returned by the API
+	Fetched int `bun:",type:integer" json:"fetched"`
+	// Filtered is the number of the fetched chats dropped by the threshold as already saved.
+	// The chats of the other authors are not counted, since they are still routed to the sinks in the live mode.
+	Filtered int `bun:",type:integer" json:"filtered"`
+	Inserted int `bun:",type:integer" json:"inserted"`
+	// Forwarded is the number of the chats accepted by the external service
+	Forwarded      int `bun:",type:integer" json:"forwarded"`
+	APICalls       int `bun:"api_calls,type:integer" json:"apiCalls"`
+	SentimentCalls int `bun:",type:integer" json:"sentimentCalls"`
+	// Commits is what the commits of the run wrote for each video
+	Commits []VideoCommit `bun:"commits,type:jsonb" json:"commits"`
+	Error   string        `bun:",type:text" json:"error,omitempty"`
+}
+
+// VideoCommit is what the commits of a run wrote for a video
+type VideoCommit struct {
 	SourceID string `json:"sourceId"`
-	ChatID   string `json:"chatId"`
+	Inserted int    `json:"inserted"`
+	// Polled is set when the poll state of the video was updated
+	Polled bool `json:"polled"`
+	// Closed is set when the chat of the video went offline and the video was marked as closed
+	Closed bool `json:"closed"`
+}
+
+// ChatCursor is the metadata returned by the LiveChat API along with the chats
+type ChatCursor struct {
+	NextPageToken   string
+	PollingInterval time.Duration
+	OfflineAt       time.Time
+}
+
+type VideoInfo struct {
+	SourceID    string    `json:"sourceId"`
+	ChatID      string    `json:"chatId"`
+	ScheduledAt time.Time `json:"-"`
 }
@@ -0,0 +1,274 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/KasumiMercury/patotta-stone-function-chat/wire"
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// OutboxDispatcher delivers the batches of the outbox to their sinks at least once.
+// The batches of a video are delivered to a sink in the order of insertion:
+// when a batch fails, the later batches of the video to the sink wait until it is delivered or dead.
+// A batch is marked dead after MaxAttempts failures and is no longer retried.
+// The batches of a sink missing from the registry are skipped and stay pending.
+type OutboxDispatcher struct {
+	repo  ChatRepository
+	sinks *SinkRegistry
+
+	// MaxAttempts is the number of the failures before the batch is marked dead
+	MaxAttempts int
+	// RetryInterval is the wait after the first failure of a batch, doubled for each failure up to MaxRetryInterval
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// BatchLimit is the maximum number of the batches of each video to each sink read in a drain
+	BatchLimit int
+	// LockTTL is the TTL of the lease of each video taken while its batches are delivered
+	LockTTL time.Duration
+
+	holder string
+}
+
+func NewOutboxDispatcher(repo ChatRepository, sinks *SinkRegistry) *OutboxDispatcher {
+	return &OutboxDispatcher{
+		repo:             repo,
+		sinks:            sinks,
+		MaxAttempts:      5,
+		RetryInterval:    30 * time.Second,
+		MaxRetryInterval: time.Hour,
+		BatchLimit:       100,
+		LockTTL:          5 * time.Minute,
+		holder:           uuid.NewString(),
+	}
+}
+
+// OutboxDispatcherFromEnv creates the dispatcher to the sinks of SinkRegistryFromEnv
+// with the optional OUTBOX_MAX_ATTEMPTS (default 5).
+// It returns nil if no sink is configured.
+func OutboxDispatcherFromEnv(repo ChatRepository) (*OutboxDispatcher, error) {
+	sinks, err := getSinkRegistry()
+	if err != nil || sinks.Len() == 0 {
+		return nil, err
+	}
+
+	d := NewOutboxDispatcher(repo, sinks)
+	if os.Getenv("OUTBOX_MAX_ATTEMPTS") != "" {
+		if d.MaxAttempts, err = getIntEnv("OUTBOX_MAX_ATTEMPTS"); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// Sinks returns the sinks that the batches are routed to
+func (d *OutboxDispatcher) Sinks() *SinkRegistry {
+	return d.sinks
+}
+
+// DispatchResult is the result of a drain of the outbox
+type DispatchResult struct {
+	// Delivered is the number of the chats in the delivered batches, counted once for each sink
+	Delivered int
+	Failed    int
+	Dead      int
+}
+
+// Drain delivers the pending batches that are due.
+// It returns an error joining the errors of the failed deliveries.
+func (d *OutboxDispatcher) Drain(ctx context.Context) (DispatchResult, error) {
+	var result DispatchResult
+
+	records, err := d.repo.ListPendingOutboxRecords(ctx, d.BatchLimit)
+	if err != nil {
+		slog.Error("Failed to list outbox records",
+			slog.Group("outbox", slog.Group("database", "error", err)),
+		)
+		return result, err
+	}
+
+	// Group the batches by the sink and the video, keeping the order of insertion
+	var queues []outboxQueue
+	batches := make(map[outboxQueue][]OutboxRecord)
+	for _, record := range records {
+		queue := outboxQueue{sink: record.Sink, sourceID: record.SourceID}
+		if _, ok := batches[queue]; !ok {
+			queues = append(queues, queue)
+		}
+		batches[queue] = append(batches[queue], record)
+	}
+
+	var errs []error
+	for _, queue := range queues {
+		if err := d.drainQueue(ctx, queue, batches[queue], &result); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(records) != 0 {
+		slog.Info("Drained outbox",
+			slog.Group("outbox", "delivered", result.Delivered, "failed", result.Failed, "dead", result.Dead),
+		)
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// outboxQueue is the batches of a video to a sink, delivered in order
+type outboxQueue struct {
+	sink     string
+	sourceID string
+}
+
+func (d *OutboxDispatcher) drainQueue(ctx context.Context, queue outboxQueue, records []OutboxRecord, result *DispatchResult) error {
+	sourceID := queue.sourceID
+	sink, ok := d.sinks.Sink(queue.sink)
+	if !ok {
+		// The batches stay pending so that they are delivered when the sink is configured again
+		slog.Warn("Skipped outbox batches of unknown sink",
+			slog.Group("outbox", "sink", queue.sink, "sourceId", sourceID, "count", len(records)),
+		)
+		return nil
+	}
+
+	// Another dispatcher delivering the same video to the sink would break the order
+	name := "outbox:" + queue.sink + ":" + sourceID
+	ok, err := d.repo.AcquireLease(ctx, name, d.holder, d.LockTTL)
+	if err != nil || !ok {
+		return err
+	}
+	defer func() {
+		if err := d.repo.ReleaseLease(context.WithoutCancel(ctx), name, d.holder); err != nil {
+			slog.Error("Failed to release lease",
+				slog.Group("lease", "name", name, slog.Group("database", "error", err)),
+			)
+		}
+	}()
+
+	var errs []error
+	now := time.Now()
+	for _, record := range records {
+		// The later batches wait for the batch waiting for its retry
+		if record.NextAttemptAt.After(now) {
+			break
+		}
+
+		err := d.deliver(ctx, sink, record)
+		record.Attempts++
+		if err == nil {
+			record.Status = OutboxStatusDelivered
+			record.DeliveredAt = time.Now()
+			record.LastError = ""
+		} else {
+			record.LastError = err.Error()
+			if record.Attempts >= d.MaxAttempts {
+				record.Status = OutboxStatusDead
+			} else {
+				record.NextAttemptAt = time.Now().Add(d.retryInterval(record.Attempts))
+			}
+		}
+
+		if uerr := d.repo.UpdateOutboxRecord(ctx, record); uerr != nil {
+			// The batch is delivered again by the next drain, which the idempotency key makes harmless
+			slog.Error("Failed to update outbox record",
+				slog.Group("outbox", "batchId", record.BatchID, slog.Group("database", "error", uerr)),
+			)
+			return errors.Join(append(errs, uerr)...)
+		}
+
+		switch record.Status {
+		case OutboxStatusDelivered:
+			result.Delivered += record.Count
+		case OutboxStatusDead:
+			result.Dead++
+			slog.Error("Outbox batch is dead",
+				slog.Group("outbox", "batchId", record.BatchID, "sink", record.Sink, "sourceId", sourceID, "attempts", record.Attempts, "error", record.LastError),
+			)
+			// The dead batch no longer blocks the later batches
+			errs = append(errs, fmt.Errorf("outbox batch %s of %s to %s is dead: %w", record.BatchID, sourceID, record.Sink, err))
+		default:
+			result.Failed++
+			return errors.Join(append(errs, fmt.Errorf("outbox batch %s of %s to %s: %w", record.BatchID, sourceID, record.Sink, err))...)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// deliver sends the envelope of the batch to the sink, which encodes it with its codec
+func (d *OutboxDispatcher) deliver(ctx context.Context, sink Sink, record OutboxRecord) error {
+	env, err := decodeOutboxPayload(record)
+	if err != nil {
+		return fmt.Errorf("decode outbox batch %s: %w", record.BatchID, err)
+	}
+	env.SentAt = time.Now().UTC()
+	return sink.Send(ctx, env)
+}
+
+// decodeOutboxPayload decodes the envelope of the batch.
+// The batches saved before the envelope are the chats of the other authors packed with MessagePack,
+// which are converted to the envelope of the schema version 1.
+func decodeOutboxPayload(record OutboxRecord) (wire.Envelope, error) {
+	var env wire.Envelope
+	err := wire.Msgpack.Unmarshal(record.Payload, &env)
+	if err == nil {
+		return env, nil
+	}
+
+	var chats []Chat
+	if lerr := msgpack.Unmarshal(record.Payload, &chats); lerr != nil {
+		return wire.Envelope{}, err
+	}
+	items := make([]wire.Item, 0, len(chats))
+	for _, chat := range chats {
+		items = append(items, wire.Item{
+			ID:              chat.ID,
+			AuthorChannelID: chat.AuthorChannelID,
+			Message:         chat.Message,
+			MessageType:     chat.MessageType,
+			PublishedAtUnix: chat.PublishedAtUnix,
+			AuthorClass:     AuthorClassOther,
+		})
+	}
+	return wire.Envelope{
+		SchemaVersion: 1,
+		VideoID:       record.SourceID,
+		BatchID:       record.BatchID,
+		Items:         items,
+	}, nil
+}
+
+// newWireEnvelope converts the chats of the video to the envelope of the batch
+func newWireEnvelope(sourceID string, batchID string, events []ChatEvent) wire.Envelope {
+	items := make([]wire.Item, 0, len(events))
+	for _, event := range events {
+		items = append(items, wire.Item{
+			ID:              event.ID,
+			AuthorChannelID: event.AuthorChannelID,
+			Message:         event.Message,
+			MessageType:     event.MessageType,
+			PublishedAtUnix: event.PublishedAt.Unix(),
+			AuthorClass:     event.AuthorClass,
+			IsNegative:      event.IsNegative,
+		})
+	}
+	return wire.Envelope{
+		SchemaVersion: wire.SchemaVersion,
+		VideoID:       sourceID,
+		BatchID:       batchID,
+		Items:         items,
+	}
+}
+
+func (d *OutboxDispatcher) retryInterval(attempts int) time.Duration {
+	interval := d.RetryInterval
+	for i := 1; i < attempts && interval < d.MaxRetryInterval; i++ {
+		interval *= 2
+	}
+	return min(interval, d.MaxRetryInterval)
+}
@@ -0,0 +1,104 @@
+package functions
+
+import (
+	"context"
+	"github.com/KasumiMercury/patotta-stone-function-chat/wire"
+	"github.com/vmihailenco/msgpack/v5"
+	"testing"
+	"time"
+)
+
+// recordingSink records the envelopes sent to it
+type recordingSink struct {
+	envelopes []wire.Envelope
+}
+
+func (s *recordingSink) Send(_ context.Context, env wire.Envelope) error {
+	s.envelopes = append(s.envelopes, env)
+	return nil
+}
+
+func TestOutboxDispatcherDeliversLegacyPayload(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	// The batch queued before the envelope is the chats packed with MessagePack
+	legacy, err := msgpack.Marshal([]Chat{
+		{ID: "1", AuthorChannelID: "viewer", Message: "hello", MessageType: "textMessageEvent", PublishedAtUnix: now.Unix(), SourceID: "video"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.InsertOutboxRecords(ctx, []OutboxRecord{{
+		Sink: legacySinkName, SourceID: "video", BatchID: "legacy", Payload: legacy, Count: 1,
+		Status: OutboxStatusPending, CreatedAt: now, NextAttemptAt: now,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{}
+	sinks := NewSinkRegistry()
+	if err := sinks.Register(legacySinkName, SinkRule{}, sink); err != nil {
+		t.Fatal(err)
+	}
+	result, err := NewOutboxDispatcher(repo, sinks).Drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Delivered != 1 {
+		t.Fatalf("delivered = %d, want 1", result.Delivered)
+	}
+
+	env := sink.envelopes[0]
+	if env.SchemaVersion != 1 || env.VideoID != "video" || env.BatchID != "legacy" || len(env.Items) != 1 {
+		t.Fatalf("envelope = %+v", env)
+	}
+	want := wire.Item{
+		ID: "1", AuthorChannelID: "viewer", Message: "hello", MessageType: "textMessageEvent",
+		PublishedAtUnix: now.Unix(), AuthorClass: AuthorClassOther,
+	}
+	if env.Items[0] != want {
+		t.Errorf("item = %+v, want %+v", env.Items[0], want)
+	}
+}
+
+func TestOutboxDispatcherSkipsUnknownSink(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	payload, err := wire.Msgpack.Marshal(wire.Envelope{SchemaVersion: wire.SchemaVersion, VideoID: "video", BatchID: "removed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.InsertOutboxRecords(ctx, []OutboxRecord{{
+		Sink: "removed", SourceID: "video", BatchID: "removed", Payload: payload, Count: 1,
+		Status: OutboxStatusPending, CreatedAt: now, NextAttemptAt: now,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sinks := NewSinkRegistry()
+	if err := sinks.Register("webhook", SinkRule{}, &recordingSink{}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := NewOutboxDispatcher(repo, sinks).Drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (DispatchResult{}) {
+		t.Errorf("result = %+v, want nothing delivered or dead", result)
+	}
+
+	// The batch is delivered once the sink is configured again
+	records, err := repo.ListPendingOutboxRecords(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Status != OutboxStatusPending || records[0].Attempts != 0 {
+		t.Errorf("records = %+v, want the batch left pending", records)
+	}
+}
@@ -0,0 +1,120 @@
+package functions
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/KasumiMercury/patotta-stone-function-chat/wire"
+	"os"
+	"strconv"
+)
+
+const (
+	// PubSubPerBatch publishes a message for each run of the chats of a batch sharing the author class and the message type
+	PubSubPerBatch = "batch"
+	// PubSubPerChat publishes a message for each chat
+	PubSubPerChat = "chat"
+)
+
+// PubSubSink publishes the batches to a topic of Google Cloud Pub/Sub.
+// The messages are ordered by the ordering key of the video ID,
+// and carry the attributes authorClass and messageType for the filters of the subscriptions.
+// The client connects to PUBSUB_EMULATOR_HOST if it is set.
+type PubSubSink struct {
+	Topic *pubsub.Topic
+	Codec wire.Codec
+	// Granularity is PubSubPerBatch or PubSubPerChat
+	Granularity string
+}
+
+// NewPubSubSink enables the message ordering of the topic
+func NewPubSubSink(topic *pubsub.Topic, codec wire.Codec, granularity string) (*PubSubSink, error) {
+	if granularity == "" {
+		granularity = PubSubPerBatch
+	}
+	if granularity != PubSubPerBatch && granularity != PubSubPerChat {
+		return nil, fmt.Errorf("unknown granularity: %q", granularity)
+	}
+	topic.EnableMessageOrdering = true
+	return &PubSubSink{Topic: topic, Codec: codec, Granularity: granularity}, nil
+}
+
+// newPubSubSinkFromConfig connects to the topic of the configuration in the project (default GOOGLE_CLOUD_PROJECT)
+func newPubSubSinkFromConfig(cfg SinkConfig, codec wire.Codec) (*PubSubSink, error) {
+	if cfg.Topic == "" {
+		return nil, errors.New("topic is required by the cloudpubsub sink")
+	}
+	project := cfg.Project
+	if project == "" {
+		project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	// The client outlives the request like the other process-wide clients
+	client, err := pubsub.NewClient(context.Background(), project)
+	if err != nil {
+		return nil, err
+	}
+	return NewPubSubSink(client.Topic(cfg.Topic), codec, cfg.Granularity)
+}
+
+// Send publishes the messages of the envelope and waits for all of them.
+// When a message fails, the later messages of the video fail too because its ordering key is paused,
+// and the batch is retried as a whole: the messages published before the failure are published again,
+// which the subscribers drop by the attributes batchId and part.
+func (s *PubSubSink) Send(ctx context.Context, env wire.Envelope) error {
+	var results []*pubsub.PublishResult
+	for i, part := range s.split(env) {
+		data, err := s.Codec.Marshal(part)
+		if err != nil {
+			return err
+		}
+		item := part.Items[0]
+		results = append(results, s.Topic.Publish(ctx, &pubsub.Message{
+			Data:        data,
+			OrderingKey: env.VideoID,
+			Attributes: map[string]string{
+				"contentType":   s.Codec.ContentType(),
+				"schemaVersion": strconv.Itoa(env.SchemaVersion),
+				"videoId":       env.VideoID,
+				"batchId":       env.BatchID,
+				// The subscribers drop the duplicates of a retried batch by the batch ID and the part
+				"part":        strconv.Itoa(i),
+				"authorClass": item.AuthorClass,
+				"messageType": item.MessageType,
+			},
+		}))
+	}
+
+	var errs []error
+	for _, result := range results {
+		if _, err := result.Get(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		// The publishing of the ordering key is paused after a failure until it is resumed
+		s.Topic.ResumePublish(env.VideoID)
+		return fmt.Errorf("publish batch %s: %w", env.BatchID, errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// split divides the envelope into the envelopes of the messages, keeping the order of the chats
+func (s *PubSubSink) split(env wire.Envelope) []wire.Envelope {
+	var parts []wire.Envelope
+	for _, item := range env.Items {
+		if s.Granularity == PubSubPerBatch && len(parts) != 0 {
+			last := &parts[len(parts)-1]
+			head := last.Items[0]
+			if head.AuthorClass == item.AuthorClass && head.MessageType == item.MessageType {
+				last.Items = append(last.Items, item)
+				continue
+			}
+		}
+		part := env
+		part.Items = []wire.Item{item}
+		parts = append(parts, part)
+	}
+	return parts
+}
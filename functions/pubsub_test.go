@@ -0,0 +1,158 @@
+package functions
+
+import (
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"context"
+	"github.com/KasumiMercury/patotta-stone-function-chat/wire"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// failPublishReactor fails the publish requests after the first succeed ones while fail is set
+type failPublishReactor struct {
+	fail    atomic.Bool
+	succeed atomic.Int32
+}
+
+func (r *failPublishReactor) React(any) (bool, any, error) {
+	if !r.fail.Load() || r.succeed.Add(-1) >= 0 {
+		return false, nil, nil
+	}
+	return true, nil, status.Error(codes.PermissionDenied, "publish failed")
+}
+
+// newTestPubSubSink creates the sink to a topic of the fake server, publishing each message in a request
+func newTestPubSubSink(t *testing.T, granularity string, reactor *failPublishReactor) (*PubSubSink, *pstest.Server) {
+	t.Helper()
+	srv := pstest.NewServer(pstest.ServerReactorOption{FuncName: "Publish", Reactor: reactor})
+	t.Cleanup(func() { srv.Close() })
+	t.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	topic, err := client.CreateTopic(ctx, "chats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic.PublishSettings.CountThreshold = 1
+	t.Cleanup(topic.Stop)
+
+	sink, err := NewPubSubSink(topic, wire.JSON, granularity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink, srv
+}
+
+// publishedParts returns the messages of the server in the order of the part attribute
+func publishedParts(t *testing.T, srv *pstest.Server) []*pstest.Message {
+	t.Helper()
+	messages := srv.Messages()
+	sort.SliceStable(messages, func(i, j int) bool {
+		pi, _ := strconv.Atoi(messages[i].Attributes["part"])
+		pj, _ := strconv.Atoi(messages[j].Attributes["part"])
+		return pi < pj
+	})
+	return messages
+}
+
+func testPubSubEnvelope() wire.Envelope {
+	return wire.Envelope{
+		SchemaVersion: wire.SchemaVersion,
+		VideoID:       "video",
+		BatchID:       "batch",
+		Items: []wire.Item{
+			{ID: "1", AuthorClass: AuthorClassTarget, MessageType: "textMessageEvent"},
+			{ID: "2", AuthorClass: AuthorClassTarget, MessageType: "textMessageEvent"},
+			{ID: "3", AuthorClass: AuthorClassOther, MessageType: "textMessageEvent"},
+			{ID: "4", AuthorClass: AuthorClassTarget, MessageType: "superChatEvent"},
+		},
+	}
+}
+
+func TestPubSubSinkSend(t *testing.T) {
+	tests := []struct {
+		granularity string
+		// want is the IDs of the chats in each message
+		want [][]string
+	}{
+		{granularity: PubSubPerBatch, want: [][]string{{"1", "2"}, {"3"}, {"4"}}},
+		{granularity: PubSubPerChat, want: [][]string{{"1"}, {"2"}, {"3"}, {"4"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.granularity, func(t *testing.T) {
+			sink, srv := newTestPubSubSink(t, tt.granularity, &failPublishReactor{})
+			if err := sink.Send(context.Background(), testPubSubEnvelope()); err != nil {
+				t.Fatal(err)
+			}
+
+			messages := publishedParts(t, srv)
+			if len(messages) != len(tt.want) {
+				t.Fatalf("messages = %d, want %d", len(messages), len(tt.want))
+			}
+			for i, message := range messages {
+				if message.OrderingKey != "video" {
+					t.Errorf("message %d: ordering key = %q, want video", i, message.OrderingKey)
+				}
+				var part wire.Envelope
+				if err := wire.JSON.Unmarshal(message.Data, &part); err != nil {
+					t.Fatal(err)
+				}
+				var ids []string
+				for _, item := range part.Items {
+					ids = append(ids, item.ID)
+					if item.AuthorClass != message.Attributes["authorClass"] || item.MessageType != message.Attributes["messageType"] {
+						t.Errorf("message %d: attributes = %v, want those of chat %s", i, message.Attributes, item.ID)
+					}
+				}
+				if strconv.Itoa(i) != message.Attributes["part"] || len(ids) != len(tt.want[i]) {
+					t.Errorf("message %d: part %s has chats %v, want %v", i, message.Attributes["part"], ids, tt.want[i])
+					continue
+				}
+				for j := range ids {
+					if ids[j] != tt.want[i][j] {
+						t.Errorf("message %d: chats %v, want %v", i, ids, tt.want[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPubSubSinkSendResumesAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	reactor := &failPublishReactor{}
+	sink, srv := newTestPubSubSink(t, PubSubPerBatch, reactor)
+
+	// Only the first part is published
+	reactor.fail.Store(true)
+	reactor.succeed.Store(1)
+	if err := sink.Send(ctx, testPubSubEnvelope()); err == nil {
+		t.Fatal("send succeeded with the failing publish")
+	}
+	if messages := srv.Messages(); len(messages) != 1 {
+		t.Fatalf("messages = %d after the failure, want 1", len(messages))
+	}
+
+	// The ordering key is resumed, so the retry publishes all the parts again
+	reactor.fail.Store(false)
+	if err := sink.Send(ctx, testPubSubEnvelope()); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	parts := make(map[string]int)
+	for _, message := range srv.Messages() {
+		parts[message.Attributes["part"]]++
+	}
+	if len(parts) != 3 || parts["0"] != 2 || parts["1"] != 1 || parts["2"] != 1 {
+		t.Errorf("published parts = %v, want part 0 twice and the others once", parts)
+	}
+}
@@ -0,0 +1,297 @@
+package functions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RetentionPolicy is how long the chats are kept in days.
+// The retention of a source is looked up by the source ID, then by the status of the video, then the default.
+// 0 means the chats are kept forever.
+//
+// For example, {"default": 0, "status": {"upcoming": 90}} keeps the free chat of upcoming videos for 90 days
+// and the chats of the other videos forever.
+type RetentionPolicy struct {
+	Default int            `json:"default"`
+	Status  map[string]int `json:"status"`
+	Sources map[string]int `json:"sources"`
+}
+
+// RetentionPolicyFromEnv reads the JSON of RETENTION_POLICY.
+// If it is not set, all the chats are kept forever.
+func RetentionPolicyFromEnv() (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	value := os.Getenv("RETENTION_POLICY")
+	if value == "" {
+		return policy, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &policy); err != nil {
+		return RetentionPolicy{}, fmt.Errorf("invalid RETENTION_POLICY: %w", err)
+	}
+	if err := policy.validate(); err != nil {
+		return RetentionPolicy{}, err
+	}
+
+	return policy, nil
+}
+
+func (p RetentionPolicy) validate() error {
+	if p.Default < 0 {
+		return fmt.Errorf("negative retention: default")
+	}
+	for status, days := range p.Status {
+		if days < 0 {
+			return fmt.Errorf("negative retention: status %s", status)
+		}
+	}
+	for source, days := range p.Sources {
+		if days < 0 {
+			return fmt.Errorf("negative retention: source %s", source)
+		}
+	}
+
+	return nil
+}
+
+// RetentionDays returns how many days the chats of the source are kept (0 means forever)
+func (p RetentionPolicy) RetentionDays(sourceID string, status string) int {
+	days := p.Default
+	if d, ok := p.Status[status]; ok {
+		days = d
+	}
+	if d, ok := p.Sources[sourceID]; ok {
+		days = d
+	}
+
+	return days
+}
+
+// ChatArchiver keeps the expired chats somewhere before they are deleted from the chats table.
+// Archive is called in the transaction that deletes the chats, so the chats are deleted only if they are archived.
+// The returned rollback is called when the transaction is rolled back, to remove what is kept outside the database.
+type ChatArchiver interface {
+	Archive(ctx context.Context, repo ChatRepository, sourceID string, records []ChatRecord) (rollback func(), err error)
+}
+
+// TableArchiver archives each batch of the chats as a row of the chat_archives table
+type TableArchiver struct{}
+
+func (TableArchiver) Archive(ctx context.Context, repo ChatRepository, sourceID string, records []ChatRecord) (func(), error) {
+	payload, err := compressChatRecords(records)
+	if err != nil {
+		return nil, err
+	}
+
+	// The row is rolled back with the transaction
+	return nil, repo.InsertChatArchiveRecord(ctx, &ChatArchiveRecord{
+		SourceID:         sourceID,
+		FirstPublishedAt: records[0].PublishedAt,
+		LastPublishedAt:  records[len(records)-1].PublishedAt,
+		Count:            len(records),
+		ArchivedAt:       time.Now(),
+		Payload:          payload,
+	})
+}
+
+// FileArchiver archives each batch of the chats as a gzip-compressed JSON Lines file
+// named <Dir>/<source ID>/<first publishedAt>-<last publishedAt>-<UUID>.jsonl.gz.
+// Dir can be a bucket of object storage mounted on the local file system.
+type FileArchiver struct {
+	Dir string
+}
+
+func (a FileArchiver) Archive(_ context.Context, _ ChatRepository, sourceID string, records []ChatRecord) (func(), error) {
+	payload, err := compressChatRecords(records)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(a.Dir, filepath.Base(sourceID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// The batches of the same publishedAt range never overwrite each other
+	name := fmt.Sprintf("%d-%d-%s.jsonl.gz", records[0].PublishedAt.Unix(), records[len(records)-1].PublishedAt.Unix(), uuid.NewString())
+	path := filepath.Join(dir, name)
+
+	// Write to a temporary file first so that the readers never see a partial archive
+	tmp, err := os.CreateTemp(dir, ".archive-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+
+	// The chats are kept in the table when the deletion is rolled back, so the archive is removed
+	return func() {
+		if err := os.Remove(path); err != nil {
+			slog.Error("Failed to remove archive of rolled back purge",
+				slog.Group("purge", "sourceId", sourceID, "path", path, "error", err),
+			)
+		}
+	}, nil
+}
+
+func compressChatRecords(records []ChatRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// PurgeOptions is the settings of PurgeChats
+type PurgeOptions struct {
+	Policy RetentionPolicy
+	// Archiver keeps the expired chats before the deletion (nil means the chats are just deleted)
+	Archiver ChatArchiver
+	// DryRun only counts the expired chats
+	DryRun bool
+	// BatchSize is the number of the chats archived and deleted in a transaction
+	BatchSize int
+	Now       time.Time
+}
+
+// PurgeReport is the result of PurgeChats for each source that has a finite retention
+type PurgeReport struct {
+	SourceID      string    `json:"sourceId"`
+	Status        string    `json:"status"`
+	RetentionDays int       `json:"retentionDays"`
+	Before        time.Time `json:"before"`
+	// Expired is the number of the chats published before the retention
+	Expired int `json:"expired"`
+	// Purged is the number of the chats actually deleted, which is always 0 in the dry run
+	Purged int `json:"purged"`
+}
+
+// PurgeChats deletes the chats older than the retention of each source
+func PurgeChats(ctx context.Context, repo ChatRepository, opts PurgeOptions) ([]PurgeReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+
+	sources, err := repo.GetChatSourceIDs(ctx)
+	if err != nil {
+		slog.Error("Failed to get source IDs of chats",
+			slog.Group("purge", slog.Group("database", "error", err)),
+		)
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	videos, err := repo.GetVideoRecordEachSource(ctx, sources)
+	if err != nil {
+		slog.Error("Failed to get video records",
+			slog.Group("purge", slog.Group("database", "error", err)),
+		)
+		return nil, err
+	}
+
+	reports := make([]PurgeReport, 0)
+	for _, sourceID := range sources {
+		// The chats of the source without the video record, such as the static target, follow the default
+		status := videos[sourceID].Status
+		days := opts.Policy.RetentionDays(sourceID, status)
+		if days == 0 {
+			continue
+		}
+
+		report := PurgeReport{
+			SourceID:      sourceID,
+			Status:        status,
+			RetentionDays: days,
+			Before:        opts.Now.AddDate(0, 0, -days),
+		}
+		report.Expired, err = repo.CountChatRecordsBefore(ctx, sourceID, report.Before)
+		if err != nil {
+			slog.Error("Failed to count expired chats",
+				slog.Group("purge", "sourceId", sourceID, slog.Group("database", "error", err)),
+			)
+			return reports, err
+		}
+		if !opts.DryRun && report.Expired > 0 {
+			report.Purged, err = purgeSource(ctx, repo, opts, sourceID, report.Before)
+			if err != nil {
+				reports = append(reports, report)
+				return reports, err
+			}
+			slog.Info("Purged expired chats",
+				slog.Group("purge", "sourceId", sourceID, "before", report.Before, "count", report.Purged),
+			)
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+func purgeSource(ctx context.Context, repo ChatRepository, opts PurgeOptions, sourceID string, before time.Time) (int, error) {
+	purged := 0
+	for {
+		var n int
+		var rollback func()
+		err := repo.RunInTx(ctx, func(ctx context.Context, repo ChatRepository) error {
+			records, err := repo.GetChatRecordsBefore(ctx, sourceID, before, opts.BatchSize)
+			if err != nil || len(records) == 0 {
+				return err
+			}
+			if opts.Archiver != nil {
+				if rollback, err = opts.Archiver.Archive(ctx, repo, sourceID, records); err != nil {
+					return fmt.Errorf("archive chats: %w", err)
+				}
+			}
+			if err := repo.DeleteChatRecords(ctx, records); err != nil {
+				return err
+			}
+			n = len(records)
+			return nil
+		})
+		if err != nil {
+			if rollback != nil {
+				rollback()
+			}
+			slog.Error("Failed to purge expired chats",
+				slog.Group("purge", "sourceId", sourceID, "purged", purged, slog.Group("database", "error", err)),
+			)
+			return purged, err
+		}
+		purged += n
+		if n < opts.BatchSize {
+			return purged, nil
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failingDeleteRepository fails the deletion of the chats in the transactions
+type failingDeleteRepository struct {
+	ChatRepository
+}
+
+func (r *failingDeleteRepository) DeleteChatRecords(context.Context, []ChatRecord) error {
+	return errors.New("delete failed")
+}
+
+func (r *failingDeleteRepository) RunInTx(ctx context.Context, fn func(ctx context.Context, repo ChatRepository) error) error {
+	return r.ChatRepository.RunInTx(ctx, func(ctx context.Context, tx ChatRepository) error {
+		return fn(ctx, &failingDeleteRepository{ChatRepository: tx})
+	})
+}
+
+func insertExpiredChats(t *testing.T, repo ChatRepository, publishedAt time.Time, ids ...string) {
+	t.Helper()
+	records := make([]ChatRecord, len(ids))
+	for i, id := range ids {
+		records[i] = ChatRecord{ID: id, Message: id, SourceID: "video", PublishedAt: publishedAt}
+	}
+	if err := repo.InsertChatRecord(context.Background(), records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func archiveFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(dir, "video"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestPurgeChatsFileArchiverUniqueNames(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	dir := t.TempDir()
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	// The batches share the publishedAt range
+	insertExpiredChats(t, repo, now.AddDate(0, 0, -30), "1", "2", "3")
+
+	reports, err := PurgeChats(ctx, repo, PurgeOptions{
+		Policy:    RetentionPolicy{Default: 7},
+		Archiver:  FileArchiver{Dir: dir},
+		BatchSize: 1,
+		Now:       now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Purged != 3 {
+		t.Fatalf("reports = %+v, want 3 purged", reports)
+	}
+	if names := archiveFiles(t, dir); len(names) != 3 {
+		t.Errorf("archives = %v, want 3 files", names)
+	}
+}
+
+func TestPurgeChatsFileArchiverRollback(t *testing.T) {
+	ctx := context.Background()
+	base := newTestRepository(t)
+	dir := t.TempDir()
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	insertExpiredChats(t, base, now.AddDate(0, 0, -30), "1", "2")
+
+	_, err := PurgeChats(ctx, &failingDeleteRepository{ChatRepository: base}, PurgeOptions{
+		Policy:   RetentionPolicy{Default: 7},
+		Archiver: FileArchiver{Dir: dir},
+		Now:      now,
+	})
+	if err == nil {
+		t.Fatal("purge succeeded with the failing deletion")
+	}
+
+	// Neither the archive nor the temporary file is left, and the chats are kept
+	if names := archiveFiles(t, dir); len(names) != 0 {
+		t.Errorf("archives = %v after the rollback, want none", names)
+	}
+	n, err := base.CountChatRecordsBefore(ctx, "video", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("chats = %d after the rollback, want 2", n)
+	}
+}
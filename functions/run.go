@@ -0,0 +1,550 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"github.com/KasumiMercury/patotta-stone-function-chat/wire"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	RunModeLive     = "live"
+	RunModeUpcoming = "upcoming"
+	RunModeStatic   = "static"
+)
+
+// youtubeListCost is the quota units of YouTube Data API consumed by a call of LiveChatMessages.List
+const youtubeListCost = 5
+
+// Run is the state of an invocation of chatWatcher: the writes to commit and the statistics
+type Run struct {
+	RunWrites
+	Record RunRecord
+	// Sentiment is the statistics of the sentiment analysis, which are not saved
+	Sentiment SentimentStats
+	// Errors is the failures of the videos that did not stop the run
+	Errors []VideoError
+	// DryRun makes the run write nothing: no leases, chats, poll states, outbox, deliveries nor run record.
+	// The writes are kept in Preview instead.
+	DryRun  bool
+	Preview RunPreview
+
+	// holder identifies the run as the holder of the leases
+	holder string
+	leases []string
+}
+
+func NewRun(span int) *Run {
+	return &Run{
+		Record: RunRecord{
+			StartedAt: time.Now(),
+			Span:      span,
+			VideoIDs:  []string{},
+			Commits:   []VideoCommit{},
+		},
+		holder: uuid.NewString(),
+	}
+}
+
+// Lock takes the lease of the video so that overlapping invocations do not process the same video.
+// When the lease is held by another run, Lock retries until wait elapses and returns false if it is still held.
+// The lease expires after ttl even if the run never releases it.
+func (r *Run) Lock(ctx context.Context, repo ChatRepository, sourceID string, ttl time.Duration, wait time.Duration) (bool, error) {
+	// The dry run never blocks the real runs
+	if r.DryRun {
+		return true, nil
+	}
+	name := "video:" + sourceID
+	deadline := time.Now().Add(wait)
+	for {
+		ok, err := repo.AcquireLease(ctx, name, r.holder, ttl)
+		if err != nil {
+			slog.Error("Failed to acquire lease",
+				slog.Group("lease", "name", name, slog.Group("database", "error", err)),
+			)
+			return false, err
+		}
+		if ok {
+			r.leases = append(r.leases, name)
+			return true, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			slog.Info("Skip video locked by another run",
+				slog.Group("lease", "name", name),
+			)
+			return false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(min(remaining, time.Second)):
+		}
+	}
+}
+
+// Unlock releases all the leases taken by the run.
+// It is supposed to be deferred so that the leases are released even when the run panics.
+func (r *Run) Unlock(ctx context.Context, repo ChatRepository) {
+	// The leases are released even if the request is canceled
+	ctx = context.WithoutCancel(ctx)
+	for _, name := range r.leases {
+		if err := repo.ReleaseLease(ctx, name, r.holder); err != nil {
+			// The lease expires after its TTL, so the failure is only logged
+			slog.Error("Failed to release lease",
+				slog.Group("lease", "name", name, slog.Group("database", "error", err)),
+			)
+		}
+	}
+	r.leases = nil
+}
+
+// SentimentStats is the statistics of the sentiment analysis in a run
+type SentimentStats struct {
+	// Analyzed is the number of the chats sent to Natural Language API
+	Analyzed int `json:"analyzed"`
+	Negative int `json:"negative"`
+	// Skipped is the number of the chats left empty by the normalization, which are never negative
+	Skipped int `json:"skipped"`
+}
+
+// VideoError is the failure of a video at a stage of the pipeline (fetch or deliver).
+// SourceID is empty for the failures not bound to a video.
+type VideoError struct {
+	SourceID string `json:"sourceId,omitempty"`
+	Stage    string `json:"stage"`
+	Error    string `json:"error"`
+}
+
+// RunPreview is the writes that a dry run would have committed
+type RunPreview struct {
+	Chats   []ChatRecord   `json:"chats"`
+	Batches []BatchPreview `json:"batches"`
+}
+
+// BatchPreview is a batch that a dry run would have queued for a sink
+type BatchPreview struct {
+	Sink     string `json:"sink"`
+	SourceID string `json:"sourceId"`
+	Count    int    `json:"count"`
+}
+
+// Fail records the failure of the video
+func (r *Run) Fail(sourceID string, stage string, err error) {
+	r.Errors = append(r.Errors, VideoError{SourceID: sourceID, Stage: stage, Error: err.Error()})
+}
+
+// Touch records that the video is processed in the run
+func (r *Run) Touch(sourceID string) {
+	if !slices.Contains(r.Record.VideoIDs, sourceID) {
+		r.Record.VideoIDs = append(r.Record.VideoIDs, sourceID)
+	}
+}
+
+// CountFetch records a call of the API that returned n chats
+func (r *Run) CountFetch(n int) {
+	r.Record.APICalls++
+	r.Record.Fetched += n
+}
+
+// CountFiltered records n chats dropped by the threshold
+func (r *Run) CountFiltered(n int) {
+	r.Record.Filtered += n
+}
+
+// CountForwarded records n chats accepted by the external service
+func (r *Run) CountForwarded(n int) {
+	r.Record.Forwarded += n
+}
+
+func (r *Run) Commit(ctx context.Context, repo ChatRepository) (CommitRecord, error) {
+	if r.DryRun {
+		return r.preview(), nil
+	}
+	record, err := r.RunWrites.Commit(ctx, repo)
+	if err != nil {
+		return record, err
+	}
+	for _, n := range record.Chats {
+		r.Record.Inserted += n
+	}
+	r.addCommit(record)
+	return record, nil
+}
+
+// addCommit merges the commit into the commits of the videos in the run record
+func (r *Run) addCommit(record CommitRecord) {
+	commit := func(sourceID string) *VideoCommit {
+		for i := range r.Record.Commits {
+			if r.Record.Commits[i].SourceID == sourceID {
+				return &r.Record.Commits[i]
+			}
+		}
+		r.Record.Commits = append(r.Record.Commits, VideoCommit{SourceID: sourceID})
+		return &r.Record.Commits[len(r.Record.Commits)-1]
+	}
+
+	// The map is iterated in the order of the source IDs to keep the record stable
+	sources := make([]string, 0, len(record.Chats))
+	for sourceID := range record.Chats {
+		sources = append(sources, sourceID)
+	}
+	slices.Sort(sources)
+	for _, sourceID := range sources {
+		commit(sourceID).Inserted += record.Chats[sourceID]
+	}
+	for _, sourceID := range record.Polled {
+		commit(sourceID).Polled = true
+	}
+	for _, sourceID := range record.Closed {
+		commit(sourceID).Closed = true
+	}
+}
+
+// preview moves the writes to Preview instead of committing them
+func (r *Run) preview() CommitRecord {
+	record := CommitRecord{CommittedAt: time.Now(), Chats: make(map[string]int)}
+	for _, chat := range r.RunWrites.Chats {
+		record.Chats[chat.SourceID]++
+		r.Record.Inserted++
+	}
+	for _, batch := range r.Outbox {
+		record.Outboxed += batch.Count
+		r.Preview.Batches = append(r.Preview.Batches, BatchPreview{Sink: batch.Sink, SourceID: batch.SourceID, Count: batch.Count})
+	}
+	r.Preview.Chats = append(r.Preview.Chats, r.RunWrites.Chats...)
+	r.addCommit(record)
+	slog.Info("Skipped commit of dry run",
+		slog.Group("commit", "chats", record.Chats, "polls", len(r.Polls), "outboxed", record.Outboxed),
+	)
+
+	r.RunWrites = RunWrites{}
+	return record
+}
+
+// Finish saves the record of the run with the error that ended the run
+func (r *Run) Finish(ctx context.Context, repo ChatRepository, err error) {
+	r.Record.EndedAt = time.Now()
+	if err != nil {
+		r.Record.Error = err.Error()
+	} else if len(r.Errors) != 0 {
+		// The partial failure is recorded as well
+		msgs := make([]string, len(r.Errors))
+		for i, e := range r.Errors {
+			msgs[i] = fmt.Sprintf("%s %s: %s", e.Stage, e.SourceID, e.Error)
+		}
+		r.Record.Error = strings.Join(msgs, "; ")
+	}
+
+	if r.DryRun {
+		slog.Info("Finished dry run",
+			slog.Group("run", "mode", r.Record.Mode, "videoIds", r.Record.VideoIDs,
+				"fetched", r.Record.Fetched, "filtered", r.Record.Filtered, "wouldInsert", r.Record.Inserted, "error", r.Record.Error),
+		)
+		return
+	}
+
+	// The record is saved even if the request is canceled
+	if err := repo.InsertRunRecord(context.WithoutCancel(ctx), &r.Record); err != nil {
+		slog.Error("Failed to save run record",
+			slog.Group("run", slog.Group("database", "error", err)),
+		)
+		return
+	}
+
+	slog.Info("Finished run",
+		slog.Group("run", "id", r.Record.ID, "mode", r.Record.Mode, "videoIds", r.Record.VideoIDs,
+			"fetched", r.Record.Fetched, "filtered", r.Record.Filtered, "inserted", r.Record.Inserted, "forwarded", r.Record.Forwarded,
+			"apiCalls", r.Record.APICalls, "sentimentCalls", r.Record.SentimentCalls, "error", r.Record.Error),
+	)
+}
+
+// RunResponse is the response of chatWatcher describing what the run did
+type RunResponse struct {
+	RunID     int64          `json:"runId,omitempty"`
+	Mode      string         `json:"mode"`
+	Videos    []string       `json:"videos"`
+	Counts    RunCounts      `json:"counts"`
+	Sentiment SentimentStats `json:"sentiment"`
+	Quota     QuotaUsage     `json:"quota"`
+	Errors    []VideoError   `json:"errors"`
+	Commits   []VideoCommit  `json:"commits"`
+	// Error is the failure that stopped the run
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	// DryRun is set with Preview, and Counts.Inserted is the number of the chats that would have been inserted
+	DryRun  bool        `json:"dryRun"`
+	Preview *RunPreview `json:"preview,omitempty"`
+}
+
+type RunCounts struct {
+	Fetched   int `json:"fetched"`
+	Filtered  int `json:"filtered"`
+	Inserted  int `json:"inserted"`
+	Forwarded int `json:"forwarded"`
+}
+
+// QuotaUsage is the quota of the APIs consumed by the run
+type QuotaUsage struct {
+	YouTubeCalls int `json:"youtubeCalls"`
+	// YouTubeUnits is estimated from the cost of LiveChatMessages.List
+	YouTubeUnits         int `json:"youtubeUnits"`
+	NaturalLanguageCalls int `json:"naturalLanguageCalls"`
+}
+
+// Response describes the run finished with err
+func (r *Run) Response(err error) RunResponse {
+	resp := RunResponse{
+		RunID:  r.Record.ID,
+		Mode:   r.Record.Mode,
+		Videos: r.Record.VideoIDs,
+		Counts: RunCounts{
+			Fetched:   r.Record.Fetched,
+			Filtered:  r.Record.Filtered,
+			Inserted:  r.Record.Inserted,
+			Forwarded: r.Record.Forwarded,
+		},
+		Sentiment: r.Sentiment,
+		Quota: QuotaUsage{
+			YouTubeCalls:         r.Record.APICalls,
+			YouTubeUnits:         r.Record.APICalls * youtubeListCost,
+			NaturalLanguageCalls: r.Record.SentimentCalls,
+		},
+		Errors:     r.Errors,
+		Commits:    r.Record.Commits,
+		DurationMs: r.Record.EndedAt.Sub(r.Record.StartedAt).Milliseconds(),
+	}
+	if resp.Errors == nil {
+		resp.Errors = []VideoError{}
+	}
+	if r.DryRun {
+		resp.DryRun = true
+		resp.Preview = &r.Preview
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// StatusCode is 200 for the run without failures, 207 for the run with the failures of some videos
+// and the success of the others, and 500 for the run stopped by err or without any successful video.
+// The videos failed before they are touched are counted as attempted.
+// The failures of no video (e.g. the delivery, which is retried from the outbox) are not fatal and make it 207.
+func (r *Run) StatusCode(err error) int {
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	if len(r.Errors) == 0 {
+		return http.StatusOK
+	}
+
+	failed := make(map[string]bool)
+	for _, e := range r.Errors {
+		if e.SourceID != "" {
+			failed[e.SourceID] = true
+		}
+	}
+	if len(failed) == 0 {
+		return http.StatusMultiStatus
+	}
+	for _, id := range r.Record.VideoIDs {
+		if !failed[id] {
+			return http.StatusMultiStatus
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// RunWrites collects the writes produced by a run.
+// Nothing is written until Commit, so a run that fails halfway leaves no partial state
+// for the calculation of the last publishedAt in the next run.
+type RunWrites struct {
+	Chats []ChatRecord
+	Polls []PollRecord
+	// Outbox is the batches of the chats to be delivered to the sinks after the commit
+	Outbox []OutboxRecord
+}
+
+// CommitRecord describes what was committed by a run
+type CommitRecord struct {
+	CommittedAt time.Time
+	// Chats is the number of inserted chats for each source ID
+	Chats map[string]int
+	// Polled is the source IDs of which the poll state was updated
+	Polled []string
+	// Closed is the source IDs of which the chat went offline in the run
+	Closed []string
+	// Outboxed is the number of the chats queued for the sinks, counted once for each sink
+	Outboxed int
+}
+
+func (w *RunWrites) AddChats(records []ChatRecord) {
+	w.Chats = append(w.Chats, records...)
+}
+
+// AddPoll records the poll of video to honor the polling interval and the offline time in the next runs.
+// A video whose chat went offline is marked as closed at the commit.
+func (w *RunWrites) AddPoll(video VideoInfo, cursor ChatCursor, now time.Time) {
+	w.Polls = append(w.Polls, PollRecord{
+		SourceID:              video.SourceID,
+		ChatID:                video.ChatID,
+		LastPolledAt:          now,
+		NextPollAt:            now.Add(cursor.PollingInterval),
+		PollingIntervalMillis: cursor.PollingInterval.Milliseconds(),
+		OfflineAt:             cursor.OfflineAt,
+	})
+	if !cursor.OfflineAt.IsZero() {
+		slog.Info("Chat went offline",
+			slog.Group("fetchChat", "chatId", video.ChatID, "sourceId", video.SourceID, "offlineAt", cursor.OfflineAt),
+		)
+	}
+}
+
+// AddOutbox records the chats of the video to be delivered to the sink by OutboxDispatcher
+func (w *RunWrites) AddOutbox(sink string, sourceID string, events []ChatEvent, now time.Time) error {
+	if len(events) == 0 {
+		return nil
+	}
+	// The envelope is stored with MessagePack and encoded with the codec of the sink at delivery
+	batchID := uuid.NewString()
+	pack, err := wire.Msgpack.Marshal(newWireEnvelope(sourceID, batchID, events))
+	if err != nil {
+		return err
+	}
+	w.Outbox = append(w.Outbox, OutboxRecord{
+		Sink:          sink,
+		SourceID:      sourceID,
+		BatchID:       batchID,
+		Payload:       pack,
+		Count:         len(events),
+		Status:        OutboxStatusPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	})
+	return nil
+}
+
+// RouteOutbox records the events to be delivered to the sinks whose rules match them
+func (w *RunWrites) RouteOutbox(sinks *SinkRegistry, events []ChatEvent, now time.Time) error {
+	for _, batch := range sinks.Route(events) {
+		if err := w.AddOutbox(batch.Sink, batch.SourceID, batch.Events, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bySource splits the writes into the writes of each video in the order of the first write of the videos
+func (w *RunWrites) bySource() []RunWrites {
+	var sources []string
+	writes := make(map[string]*RunWrites)
+	get := func(sourceID string) *RunWrites {
+		if _, ok := writes[sourceID]; !ok {
+			sources = append(sources, sourceID)
+			writes[sourceID] = &RunWrites{}
+		}
+		return writes[sourceID]
+	}
+	for _, chat := range w.Chats {
+		get(chat.SourceID).Chats = append(get(chat.SourceID).Chats, chat)
+	}
+	for _, poll := range w.Polls {
+		get(poll.SourceID).Polls = append(get(poll.SourceID).Polls, poll)
+	}
+	for _, batch := range w.Outbox {
+		get(batch.SourceID).Outbox = append(get(batch.SourceID).Outbox, batch)
+	}
+
+	result := make([]RunWrites, 0, len(sources))
+	for _, sourceID := range sources {
+		result = append(result, *writes[sourceID])
+	}
+	return result
+}
+
+func (w *RunWrites) IsEmpty() bool {
+	return len(w.Chats) == 0 && len(w.Polls) == 0 && len(w.Outbox) == 0
+}
+
+// Commit writes all the collected writes in a single transaction.
+// On failure, the transaction is rolled back and the writes are kept to be retried.
+// On success, the writes are cleared.
+func (w *RunWrites) Commit(ctx context.Context, repo ChatRepository) (CommitRecord, error) {
+	record := CommitRecord{Chats: make(map[string]int)}
+	if w.IsEmpty() {
+		return record, nil
+	}
+
+	err := repo.RunInTx(ctx, func(ctx context.Context, repo ChatRepository) error {
+		if len(w.Chats) != 0 {
+			if err := repo.InsertChatRecord(ctx, w.Chats); err != nil {
+				slog.Error("Failed to insert chat records",
+					slog.Group("saveChat", slog.Group("database", "error", err)),
+				)
+				return err
+			}
+		}
+		for _, poll := range w.Polls {
+			if err := repo.UpsertPollRecord(ctx, poll); err != nil {
+				slog.Error("Failed to record poll",
+					slog.Group("fetchChat", "sourceId", poll.SourceID, slog.Group("database", "error", err)),
+				)
+				return err
+			}
+			if poll.OfflineAt.IsZero() {
+				continue
+			}
+			if err := repo.UpdateVideoStatus(ctx, poll.SourceID, VideoStatusClosed, poll.LastPolledAt); err != nil {
+				slog.Error("Failed to close video",
+					slog.Group("fetchChat", "sourceId", poll.SourceID, slog.Group("database", "error", err)),
+				)
+				return err
+			}
+		}
+		if len(w.Outbox) != 0 {
+			if err := repo.InsertOutboxRecords(ctx, w.Outbox); err != nil {
+				slog.Error("Failed to insert outbox records",
+					slog.Group("outbox", slog.Group("database", "error", err)),
+				)
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to commit run",
+			slog.Group("commit", "chats", len(w.Chats), "polls", len(w.Polls), "outbox", len(w.Outbox), slog.Group("database", "error", err)),
+		)
+		return record, err
+	}
+
+	record.CommittedAt = time.Now()
+	for _, chat := range w.Chats {
+		record.Chats[chat.SourceID]++
+	}
+	for _, poll := range w.Polls {
+		record.Polled = append(record.Polled, poll.SourceID)
+		if !poll.OfflineAt.IsZero() {
+			record.Closed = append(record.Closed, poll.SourceID)
+		}
+	}
+	for _, batch := range w.Outbox {
+		record.Outboxed += batch.Count
+	}
+	slog.Info("Committed run",
+		slog.Group("commit", "chats", record.Chats, "polled", record.Polled, "closed", record.Closed, "outboxed", record.Outboxed),
+	)
+
+	w.Chats = nil
+	w.Polls = nil
+	w.Outbox = nil
+
+	return record, nil
+}
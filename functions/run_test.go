@@ -0,0 +1,124 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunWritesCommitClosesOfflineVideo(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	videos := []VideoRecord{
+		{SourceID: "offline", Status: "live", ChatID: "chat-offline", UpdatedAt: now.Add(-time.Hour)},
+		{SourceID: "online", Status: "live", ChatID: "chat-online", UpdatedAt: now.Add(-time.Hour)},
+	}
+	if _, err := repo.db.NewInsert().Model(&videos).Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var writes RunWrites
+	writes.AddPoll(VideoInfo{SourceID: "offline", ChatID: "chat-offline"}, ChatCursor{PollingInterval: time.Second, OfflineAt: now.Add(-time.Minute)}, now)
+	writes.AddPoll(VideoInfo{SourceID: "online", ChatID: "chat-online"}, ChatCursor{PollingInterval: time.Second}, now)
+
+	record, err := writes.Commit(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Closed) != 1 || record.Closed[0] != "offline" {
+		t.Errorf("Closed = %v, want [offline]", record.Closed)
+	}
+
+	got, err := repo.GetVideoRecordEachSource(ctx, []string{"offline", "online"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["offline"].Status != VideoStatusClosed {
+		t.Errorf("status of offline = %q, want %q", got["offline"].Status, VideoStatusClosed)
+	}
+	if got["online"].Status != "live" {
+		t.Errorf("status of online = %q, want live", got["online"].Status)
+	}
+}
+
+func TestRunFinishSavesCommits(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	now := time.Now().Truncate(time.Second)
+
+	run := NewRun(60)
+	run.Record.Mode = RunModeLive
+	run.AddChats([]ChatRecord{
+		{ID: "1", Message: "a", SourceID: "live", PublishedAt: now},
+		{ID: "2", Message: "b", SourceID: "live", PublishedAt: now},
+	})
+	run.AddPoll(VideoInfo{SourceID: "live", ChatID: "chat-live"}, ChatCursor{}, now)
+	run.AddPoll(VideoInfo{SourceID: "ended", ChatID: "chat-ended"}, ChatCursor{OfflineAt: now}, now)
+	if _, err := run.Commit(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	run.AddChats([]ChatRecord{{ID: "3", Message: "c", SourceID: "live", PublishedAt: now}})
+	if _, err := run.Commit(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	run.Finish(ctx, repo, nil)
+
+	records, err := repo.ListRunRecords(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("runs = %d, want 1", len(records))
+	}
+	want := []VideoCommit{
+		{SourceID: "live", Inserted: 3, Polled: true},
+		{SourceID: "ended", Polled: true, Closed: true},
+	}
+	if !reflect.DeepEqual(records[0].Commits, want) {
+		t.Errorf("commits = %+v, want %+v", records[0].Commits, want)
+	}
+	if records[0].Inserted != 3 {
+		t.Errorf("inserted = %d, want 3", records[0].Inserted)
+	}
+}
+
+func TestRunStatusCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		touched []string
+		failed  []string
+		err     error
+		want    int
+	}{
+		{name: "no failures", touched: []string{"a"}, want: http.StatusOK},
+		{name: "nothing to do", want: http.StatusOK},
+		{name: "stopped", touched: []string{"a"}, err: errors.New("stopped"), want: http.StatusInternalServerError},
+		{name: "some videos failed", touched: []string{"a", "b"}, failed: []string{"b"}, want: http.StatusMultiStatus},
+		{name: "untouched video failed", touched: []string{"a"}, failed: []string{"b"}, want: http.StatusMultiStatus},
+		{name: "all videos failed", touched: []string{"a"}, failed: []string{"a"}, want: http.StatusInternalServerError},
+		{name: "only untouched videos failed", failed: []string{"a", "b"}, want: http.StatusInternalServerError},
+		// The failed delivery is retried from the outbox, so the run is not redelivered for it
+		{name: "delivery failed without videos", failed: []string{""}, want: http.StatusMultiStatus},
+		{name: "delivery failed with videos", touched: []string{"a"}, failed: []string{""}, want: http.StatusMultiStatus},
+		{name: "delivery and all videos failed", touched: []string{"a"}, failed: []string{"", "a"}, want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := NewRun(60)
+			for _, id := range tt.touched {
+				run.Touch(id)
+			}
+			for _, id := range tt.failed {
+				run.Fail(id, "fetch", errors.New("failed"))
+			}
+			if got := run.StatusCode(tt.err); got != tt.want {
+				t.Errorf("StatusCode = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// runsHandler lists the recent runs of chatWatcher for operators.
+// The caller is authenticated by ADMIN_TOKENS like the overrides of chatWatcher.
+func runsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// Set custom logger
+	logger := NewCustomLogger(ctx)
+	slog.SetDefault(logger)
+
+	if status, err := authorizeOverrides(r); err != nil {
+		slog.Warn("Rejected runs request",
+			slog.Group("runs", "status", status, "error", err),
+		)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	limit, err := getLimitQuery(r.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repo, err := getChatRepository(ctx)
+	if err != nil {
+		slog.Error("Failed to create Database client",
+			slog.Group("database", "error", err),
+		)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	records, err := repo.ListRunRecords(ctx, limit)
+	if err != nil {
+		slog.Error("Failed to list run records",
+			slog.Group("runs", slog.Group("database", "error", err)),
+		)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		slog.Error("Failed to write run records", "error", err)
+	}
+}
+
+func getLimitQuery(u *url.URL) (int, error) {
+	// Default value is 20 runs, and at most 100 runs are returned at once
+	defVal := 20
+	maxVal := 100
+
+	limit := u.Query().Get("limit")
+	if limit == "" {
+		return defVal, nil
+	}
+
+	limitInt, err := strconv.Atoi(limit)
+	if err != nil || limitInt <= 0 {
+		return defVal, fmt.Errorf("invalid limit: %s", limit)
+	}
+	if limitInt > maxVal {
+		return defVal, fmt.Errorf("limit value too large: %d exceeds maximum of %d", limitInt, maxVal)
+	}
+
+	return limitInt, nil
+}
@@ -0,0 +1,54 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunsHandlerRequiresToken(t *testing.T) {
+	t.Setenv("LOCAL_ONLY", "true")
+	repo := newTestRepository(t)
+	useTestRepository(t, repo)
+	run := NewRun(60)
+	run.Finish(context.Background(), repo, nil)
+
+	tests := []struct {
+		name   string
+		tokens string
+		header string
+		want   int
+	}{
+		{name: "no tokens configured", tokens: "", header: "Bearer secret", want: http.StatusForbidden},
+		{name: "missing token", tokens: "secret", header: "", want: http.StatusUnauthorized},
+		{name: "invalid token", tokens: "secret", header: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "valid token", tokens: "old,secret", header: "Bearer secret", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKENS", tt.tokens)
+			req := httptest.NewRequest(http.MethodGet, "/runs", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			runsHandler(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var records []RunRecord
+			if err := json.NewDecoder(rec.Body).Decode(&records); err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 {
+				t.Errorf("runs = %d, want 1", len(records))
+			}
+		})
+	}
+}
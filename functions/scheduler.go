@@ -0,0 +1,104 @@
+package functions
+
+import (
+	"sort"
+	"time"
+)
+
+// PollScheduler decides which upcoming video is polled in the current run.
+// Only one upcoming video is fetched per run to save the quota of YouTube API,
+// so the scheduler has to share the runs fairly between the videos.
+type PollScheduler struct {
+	// Interval is the maximum time a video may wait between two polls.
+	// A video that has not been polled within the interval is always picked first.
+	Interval time.Duration
+	// Horizon is the distance to the scheduled start time from which the priority starts to grow.
+	Horizon time.Duration
+}
+
+func NewPollScheduler(interval time.Duration) PollScheduler {
+	return PollScheduler{
+		Interval: interval,
+		Horizon:  24 * time.Hour,
+	}
+}
+
+// Pick returns the video to be polled at now.
+// lastPolled holds the last polled time of each video keyed by the source ID.
+// The second return value is false when videos is empty.
+func (s PollScheduler) Pick(videos []VideoInfo, lastPolled map[string]time.Time, now time.Time) (VideoInfo, bool) {
+	if len(videos) == 0 {
+		return VideoInfo{}, false
+	}
+
+	// Sort the candidates by the source ID
+	// so that ties are always broken in the same order regardless of the order of the records
+	candidates := make([]VideoInfo, len(videos))
+	copy(candidates, videos)
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].SourceID < candidates[j].SourceID })
+
+	var overdue []VideoInfo
+	for _, video := range candidates {
+		if s.isOverdue(lastPolled[video.SourceID], now) {
+			overdue = append(overdue, video)
+		}
+	}
+
+	// The video waiting for the longest time is picked from the overdue videos
+	// to guarantee that every video is polled within the interval.
+	// A video that has never been polled is treated as waiting since the zero time.
+	if len(overdue) > 0 {
+		target := overdue[0]
+		for _, video := range overdue[1:] {
+			if lastPolled[video.SourceID].Before(lastPolled[target.SourceID]) {
+				target = video
+			}
+		}
+		return target, true
+	}
+
+	// When no video is overdue, the elapsed time since the last poll is weighted
+	// by the proximity of the scheduled start time.
+	target := candidates[0]
+	bestScore := s.score(target, lastPolled[target.SourceID], now)
+	for _, video := range candidates[1:] {
+		score := s.score(video, lastPolled[video.SourceID], now)
+		if score > bestScore {
+			target = video
+			bestScore = score
+		}
+	}
+
+	return target, true
+}
+
+func (s PollScheduler) isOverdue(lastPolled time.Time, now time.Time) bool {
+	if lastPolled.IsZero() {
+		return true
+	}
+	if s.Interval <= 0 {
+		return false
+	}
+	return now.Sub(lastPolled) >= s.Interval
+}
+
+func (s PollScheduler) score(video VideoInfo, lastPolled time.Time, now time.Time) float64 {
+	elapsed := now.Sub(lastPolled).Seconds()
+	return elapsed * s.weight(video.ScheduledAt, now)
+}
+
+func (s PollScheduler) weight(scheduledAt time.Time, now time.Time) float64 {
+	// Videos without a scheduled start time get the base weight
+	if scheduledAt.IsZero() || s.Horizon <= 0 {
+		return 1
+	}
+
+	// The weight grows as the scheduled start time approaches,
+	// and is capped when the scheduled start time has already passed.
+	until := scheduledAt.Sub(now)
+	if until < 0 {
+		until = 0
+	}
+
+	return 1 + s.Horizon.Hours()/(until.Hours()+1)
+}
@@ -0,0 +1,176 @@
+package functions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollSchedulerPick(t *testing.T) {
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	in := func(d time.Duration) time.Time { return now.Add(d) }
+
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		videos     []VideoInfo
+		lastPolled map[string]time.Time
+		want       string
+	}{
+		{
+			name:     "never polled video first",
+			interval: time.Hour,
+			videos:   []VideoInfo{{SourceID: "a"}, {SourceID: "b"}},
+			lastPolled: map[string]time.Time{
+				"a": ago(30 * time.Minute),
+			},
+			want: "b",
+		},
+		{
+			name:       "ties broken by source ID regardless of order",
+			interval:   time.Hour,
+			videos:     []VideoInfo{{SourceID: "c"}, {SourceID: "b"}, {SourceID: "a"}},
+			lastPolled: map[string]time.Time{},
+			want:       "a",
+		},
+		{
+			name:     "longest waiting video without schedule",
+			interval: time.Hour,
+			videos:   []VideoInfo{{SourceID: "a"}, {SourceID: "b"}, {SourceID: "c"}},
+			lastPolled: map[string]time.Time{
+				"a": ago(10 * time.Minute),
+				"b": ago(40 * time.Minute),
+				"c": ago(20 * time.Minute),
+			},
+			want: "b",
+		},
+		{
+			name:     "closer scheduled start time wins on equal wait",
+			interval: time.Hour,
+			videos: []VideoInfo{
+				{SourceID: "a", ScheduledAt: in(20 * time.Hour)},
+				{SourceID: "b", ScheduledAt: in(30 * time.Minute)},
+			},
+			lastPolled: map[string]time.Time{
+				"a": ago(20 * time.Minute),
+				"b": ago(20 * time.Minute),
+			},
+			want: "b",
+		},
+		{
+			name:     "scheduled weight outweighs a longer wait",
+			interval: time.Hour,
+			videos: []VideoInfo{
+				{SourceID: "a"},
+				{SourceID: "b", ScheduledAt: in(time.Hour)},
+			},
+			lastPolled: map[string]time.Time{
+				"a": ago(40 * time.Minute),
+				"b": ago(10 * time.Minute),
+			},
+			want: "b",
+		},
+		{
+			name:     "passed scheduled start time is capped",
+			interval: time.Hour,
+			videos: []VideoInfo{
+				{SourceID: "a", ScheduledAt: ago(10 * time.Hour)},
+				{SourceID: "b", ScheduledAt: in(10 * time.Minute)},
+			},
+			lastPolled: map[string]time.Time{
+				"a": ago(20 * time.Minute),
+				"b": ago(10 * time.Minute),
+			},
+			want: "a",
+		},
+		{
+			name:     "overdue video wins over a heavier weight",
+			interval: time.Hour,
+			videos: []VideoInfo{
+				{SourceID: "a", ScheduledAt: in(48 * time.Hour)},
+				{SourceID: "b", ScheduledAt: in(5 * time.Minute)},
+			},
+			lastPolled: map[string]time.Time{
+				"a": ago(time.Hour),
+				"b": ago(50 * time.Minute),
+			},
+			want: "a",
+		},
+		{
+			name:     "oldest of the overdue videos",
+			interval: time.Hour,
+			videos: []VideoInfo{
+				{SourceID: "a", ScheduledAt: in(time.Minute)},
+				{SourceID: "b"},
+				{SourceID: "c"},
+			},
+			lastPolled: map[string]time.Time{
+				"a": ago(2 * time.Hour),
+				"b": ago(3 * time.Hour),
+				"c": ago(10 * time.Minute),
+			},
+			want: "b",
+		},
+		{
+			name:     "no interval cap without interval",
+			interval: 0,
+			videos: []VideoInfo{
+				{SourceID: "a"},
+				{SourceID: "b", ScheduledAt: in(time.Hour)},
+			},
+			lastPolled: map[string]time.Time{
+				"a": ago(5 * time.Hour),
+				"b": ago(2 * time.Hour),
+			},
+			want: "b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := NewPollScheduler(tt.interval).Pick(tt.videos, tt.lastPolled, now)
+			if !ok {
+				t.Fatal("Pick returned no video")
+			}
+			if got.SourceID != tt.want {
+				t.Errorf("Pick = %s, want %s", got.SourceID, tt.want)
+			}
+		})
+	}
+}
+
+func TestPollSchedulerPickEmpty(t *testing.T) {
+	if _, ok := NewPollScheduler(time.Hour).Pick(nil, nil, time.Now()); ok {
+		t.Error("Pick returned a video for no candidates")
+	}
+}
+
+// TestPollSchedulerFairness simulates the runs and checks that every video is polled within the interval
+func TestPollSchedulerFairness(t *testing.T) {
+	start := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	videos := []VideoInfo{
+		{SourceID: "soon", ScheduledAt: start.Add(30 * time.Minute)},
+		{SourceID: "today", ScheduledAt: start.Add(6 * time.Hour)},
+		{SourceID: "later", ScheduledAt: start.Add(72 * time.Hour)},
+		{SourceID: "unscheduled"},
+	}
+	scheduler := NewPollScheduler(10 * time.Minute)
+	lastPolled := make(map[string]time.Time)
+	counts := make(map[string]int)
+
+	for i := 0; i < 120; i++ {
+		now := start.Add(time.Duration(i) * time.Minute)
+		for _, video := range videos {
+			if last, ok := lastPolled[video.SourceID]; ok && now.Sub(last) > scheduler.Interval+time.Duration(len(videos))*time.Minute {
+				t.Fatalf("%s waited %s at %s", video.SourceID, now.Sub(last), now)
+			}
+		}
+		video, _ := scheduler.Pick(videos, lastPolled, now)
+		lastPolled[video.SourceID] = now
+		counts[video.SourceID]++
+	}
+
+	if counts["soon"] <= counts["later"] {
+		t.Errorf("soon polled %d times, later %d times", counts["soon"], counts["later"])
+	}
+}
@@ -0,0 +1,336 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/KasumiMercury/patotta-stone-function-chat/wire"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	// SinkTypeHTTP posts the encoded batches to a webhook
+	SinkTypeHTTP = "http"
+	// SinkTypeFile writes each encoded batch to a file
+	SinkTypeFile = "file"
+	// SinkTypePubSub posts the encoded batches to a Pub/Sub-compatible publish endpoint
+	SinkTypePubSub = "pubsub"
+	// SinkTypeCloudPubSub publishes the encoded batches to a topic of Google Cloud Pub/Sub with the client library
+	SinkTypeCloudPubSub = "cloudpubsub"
+)
+
+// legacySinkName is the name of the sink configured by EXTERNAL_SERVICE_URL
+const legacySinkName = "external"
+
+// Sink receives the batches of chats routed to it.
+// A batch failed by Send is retried by OutboxDispatcher, so Send must tolerate the same batch twice.
+type Sink interface {
+	Send(ctx context.Context, env wire.Envelope) error
+}
+
+// SinkRule selects the chats routed to a sink. The zero values match all the chats.
+type SinkRule struct {
+	// AuthorClass is AuthorClassTarget or AuthorClassOther
+	AuthorClass  string   `json:"authorClass"`
+	MessageTypes []string `json:"messageTypes"`
+	Negative     *bool    `json:"negative"`
+	SourceIDs    []string `json:"sourceIds"`
+}
+
+func (r SinkRule) Match(event ChatEvent) bool {
+	if r.AuthorClass != "" && r.AuthorClass != event.AuthorClass {
+		return false
+	}
+	if len(r.MessageTypes) != 0 && !slices.Contains(r.MessageTypes, event.MessageType) {
+		return false
+	}
+	if r.Negative != nil && *r.Negative != event.IsNegative {
+		return false
+	}
+	if len(r.SourceIDs) != 0 && !slices.Contains(r.SourceIDs, event.SourceID) {
+		return false
+	}
+	return true
+}
+
+// SinkConfig is the declarative configuration of a sink
+type SinkConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// URL is the webhook of the http sink and the publish endpoint of the pubsub sink
+	URL string `json:"url"`
+	// Dir is the directory of the file sink
+	Dir string `json:"dir"`
+	// Project (default GOOGLE_CLOUD_PROJECT), Topic and Granularity (batch or chat; default batch) configure the cloudpubsub sink
+	Project     string `json:"project"`
+	Topic       string `json:"topic"`
+	Granularity string `json:"granularity"`
+	// Encoding is msgpack (default), json or protobuf
+	Encoding string `json:"encoding"`
+	// Timeout is the timeout of each attempt of the http and pubsub sinks (default 10s)
+	Timeout string `json:"timeout"`
+	// MaxRetries is the number of the retries in a delivery of the http and pubsub sinks (default 3)
+	MaxRetries *int     `json:"maxRetries"`
+	Match      SinkRule `json:"match"`
+}
+
+// NewSink creates the sink of the configuration.
+// The requests of the http sinks are signed with SIGNING_KEYS.
+func NewSink(cfg SinkConfig) (Sink, error) {
+	name := cfg.Encoding
+	if name == "" {
+		name = wire.Msgpack.Name()
+	}
+	codec, err := wire.CodecByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Type {
+	case SinkTypeHTTP, SinkTypePubSub:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("url is required by the %s sink", cfg.Type)
+		}
+		timeout := 10 * time.Second
+		if cfg.Timeout != "" {
+			if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+				return nil, fmt.Errorf("invalid timeout: %w", err)
+			}
+		}
+		maxRetries := 3
+		if cfg.MaxRetries != nil {
+			maxRetries = *cfg.MaxRetries
+		}
+		client := NewDeliveryClient(cfg.URL, timeout, maxRetries)
+
+		if cfg.Type == SinkTypePubSub {
+			return &PubSubHTTPSink{Client: client, Codec: codec}, nil
+		}
+		if client.Signer, err = signerFromEnv(); err != nil {
+			return nil, err
+		}
+		return &HTTPSink{Client: client, Codec: codec}, nil
+	case SinkTypeFile:
+		if cfg.Dir == "" {
+			return nil, fmt.Errorf("dir is required by the file sink")
+		}
+		return &FileSink{Dir: cfg.Dir, Codec: codec}, nil
+	case SinkTypeCloudPubSub:
+		return newPubSubSinkFromConfig(cfg, codec)
+	default:
+		return nil, fmt.Errorf("unknown sink type: %q", cfg.Type)
+	}
+}
+
+// SinkRegistry is the set of the sinks with their rules
+type SinkRegistry struct {
+	sinks []registeredSink
+}
+
+type registeredSink struct {
+	name string
+	rule SinkRule
+	sink Sink
+}
+
+// SinkBatch is the chats of a video routed to a sink
+type SinkBatch struct {
+	Sink     string
+	SourceID string
+	Events   []ChatEvent
+}
+
+func NewSinkRegistry() *SinkRegistry {
+	return &SinkRegistry{}
+}
+
+// Register adds the sink under the name, which is recorded with the batches in the outbox
+func (r *SinkRegistry) Register(name string, rule SinkRule, sink Sink) error {
+	if name == "" {
+		return errors.New("sink name is empty")
+	}
+	if _, ok := r.Sink(name); ok {
+		return fmt.Errorf("duplicate sink: %s", name)
+	}
+	r.sinks = append(r.sinks, registeredSink{name: name, rule: rule, sink: sink})
+	return nil
+}
+
+// Sink returns the sink registered under the name
+func (r *SinkRegistry) Sink(name string) (Sink, bool) {
+	for _, s := range r.sinks {
+		if s.name == name {
+			return s.sink, true
+		}
+	}
+	return nil, false
+}
+
+func (r *SinkRegistry) Len() int {
+	return len(r.sinks)
+}
+
+// Route splits the events into the batches of each sink and each video,
+// keeping the order of the events and the order of the registration of the sinks.
+func (r *SinkRegistry) Route(events []ChatEvent) []SinkBatch {
+	var batches []SinkBatch
+	for _, s := range r.sinks {
+		var sources []string
+		bySource := make(map[string][]ChatEvent)
+		for _, event := range events {
+			if !s.rule.Match(event) {
+				continue
+			}
+			if _, ok := bySource[event.SourceID]; !ok {
+				sources = append(sources, event.SourceID)
+			}
+			bySource[event.SourceID] = append(bySource[event.SourceID], event)
+		}
+		for _, sourceID := range sources {
+			batches = append(batches, SinkBatch{Sink: s.name, SourceID: sourceID, Events: bySource[sourceID]})
+		}
+	}
+	return batches
+}
+
+// SinkRegistryFromEnv creates the sinks of SINKS, a JSON array of SinkConfig, e.g.
+//
+//	[{"name": "analysis", "type": "http", "url": "https://example.com/chats", "encoding": "json", "match": {"authorClass": "other"}},
+//	 {"name": "negative", "type": "file", "dir": "/var/chats", "match": {"authorClass": "target", "negative": true}},
+//	 {"name": "topic", "type": "cloudpubsub", "topic": "chats", "granularity": "chat"}]
+//
+// Without SINKS, EXTERNAL_SERVICE_URL is registered as the http sink receiving the other chats
+// with EXTERNAL_SERVICE_ENCODING (msgpack, json or protobuf; default msgpack).
+func SinkRegistryFromEnv() (*SinkRegistry, error) {
+	registry := NewSinkRegistry()
+
+	value := os.Getenv("SINKS")
+	if value == "" {
+		client, err := DeliveryClientFromEnv()
+		if err != nil || client == nil {
+			return registry, err
+		}
+		codec := wire.Msgpack
+		if name := os.Getenv("EXTERNAL_SERVICE_ENCODING"); name != "" {
+			if codec, err = wire.CodecByName(name); err != nil {
+				return nil, err
+			}
+		}
+		err = registry.Register(legacySinkName, SinkRule{AuthorClass: AuthorClassOther}, &HTTPSink{Client: client, Codec: codec})
+		return registry, err
+	}
+
+	var configs []SinkConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, fmt.Errorf("invalid SINKS: %w", err)
+	}
+	for _, cfg := range configs {
+		sink, err := NewSink(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sink %s: %w", cfg.Name, err)
+		}
+		if err := registry.Register(cfg.Name, cfg.Match, sink); err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
+
+// HTTPSink posts the encoded batches with DeliveryClient
+type HTTPSink struct {
+	Client *DeliveryClient
+	Codec  wire.Codec
+}
+
+func (s *HTTPSink) Send(ctx context.Context, env wire.Envelope) error {
+	body, err := s.Codec.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return s.Client.Deliver(ctx, env.BatchID, s.Codec.ContentType(), body)
+}
+
+// fileExtensions is the extensions of the files written by FileSink for each codec
+var fileExtensions = map[string]string{
+	"msgpack":  ".msgpack",
+	"json":     ".json",
+	"protobuf": ".pb",
+}
+
+// FileSink writes each batch to <Dir>/<video ID>/<batch ID>.<extension>.
+// A batch sent again overwrites its file.
+type FileSink struct {
+	Dir   string
+	Codec wire.Codec
+}
+
+func (s *FileSink) Send(ctx context.Context, env wire.Envelope) error {
+	body, err := s.Codec.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.Dir, filepath.Base(env.VideoID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so that the readers never see a partial batch
+	tmp, err := os.CreateTemp(dir, ".batch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, filepath.Base(env.BatchID)+fileExtensions[s.Codec.Name()]))
+}
+
+// PubSubHTTPSink publishes each batch as a message to the REST publish endpoint of Pub/Sub,
+// e.g. http://localhost:8085/v1/projects/<project>/topics/<topic>:publish of the emulator or a compatible proxy.
+// The endpoint is called without Google credentials.
+type PubSubHTTPSink struct {
+	Client *DeliveryClient
+	Codec  wire.Codec
+}
+
+// pubsubPublishRequest is the body of projects.topics.publish
+type pubsubPublishRequest struct {
+	Messages []pubsubMessage `json:"messages"`
+}
+
+type pubsubMessage struct {
+	// Data is encoded with base64 by encoding/json
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func (s *PubSubHTTPSink) Send(ctx context.Context, env wire.Envelope) error {
+	data, err := s.Codec.Marshal(env)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(pubsubPublishRequest{Messages: []pubsubMessage{{
+		Data: data,
+		Attributes: map[string]string{
+			"contentType":   s.Codec.ContentType(),
+			"schemaVersion": fmt.Sprint(env.SchemaVersion),
+			"videoId":       env.VideoID,
+			"batchId":       env.BatchID,
+		},
+	}}})
+	if err != nil {
+		return err
+	}
+	return s.Client.Deliver(ctx, env.BatchID, "application/json", body)
+}
@@ -0,0 +1,317 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/option"
+	"google.golang.org/api/youtube/v3"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ChatSource fetches the chats of a live chat.
+// pageToken is the NextPageToken of the previous cursor, or empty for the first fetch.
+type ChatSource interface {
+	FetchChats(ctx context.Context, video VideoInfo, pageToken string) ([]Chat, ChatCursor, error)
+}
+
+// PollingChatSource fetches the chats by polling LiveChatMessages.List of YouTube Data API
+type PollingChatSource struct {
+	ytSvc *youtube.Service
+}
+
+func NewPollingChatSource(ytSvc *youtube.Service) *PollingChatSource {
+	return &PollingChatSource{ytSvc: ytSvc}
+}
+
+func (s *PollingChatSource) FetchChats(ctx context.Context, video VideoInfo, pageToken string) ([]Chat, ChatCursor, error) {
+	return fetchChatsByChatID(ctx, s.ytSvc, video, 0, pageToken)
+}
+
+// NewChatSource creates the chat source selected by the environment variable CHAT_SOURCE.
+//   - "polling" (default): LiveChatMessages.List of YouTube Data API
+//   - "stream": liveChatMessages.streamList of YouTube Data API
+//   - "replay": the recorded fixture at CHAT_FIXTURE, without network
+//
+// When CHAT_FIXTURE is set with the other sources, the fetched chats are recorded to the fixture.
+// The returned source may implement io.Closer.
+func NewChatSource(ctx context.Context, ytApiKey string) (ChatSource, error) {
+	fixture := os.Getenv("CHAT_FIXTURE")
+
+	var source ChatSource
+	switch mode := os.Getenv("CHAT_SOURCE"); mode {
+	case "", "polling":
+		ytSvc, err := youtube.NewService(ctx, option.WithAPIKey(ytApiKey))
+		if err != nil {
+			return nil, err
+		}
+		source = NewPollingChatSource(ytSvc)
+	case "stream":
+		s, err := NewStreamChatSource(DefaultStreamTarget, ytApiKey)
+		if err != nil {
+			return nil, err
+		}
+		source = s
+	case "replay":
+		if fixture == "" {
+			return nil, fmt.Errorf("CHAT_FIXTURE is required for the replay source")
+		}
+		return LoadReplayChatSource(fixture)
+	default:
+		return nil, fmt.Errorf("unknown chat source: %s", mode)
+	}
+
+	if fixture != "" {
+		return NewRecordingChatSource(source, fixture), nil
+	}
+	return source, nil
+}
+
+// isStreamingSource reports whether FetchChats blocks until the next chats arrive
+func isStreamingSource(source ChatSource) bool {
+	switch s := source.(type) {
+	case *StreamChatSource:
+		return true
+	case *RecordingChatSource:
+		return isStreamingSource(s.source)
+	default:
+		return false
+	}
+}
+
+// closeChatSource closes the source if it holds any connection
+func closeChatSource(source ChatSource) {
+	closer, ok := source.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		slog.Error("Failed to close chat source", "error", err)
+	}
+}
+
+// ChatFixture is the recorded responses of a chat source keyed by the chat ID
+type ChatFixture map[string][]FixturePage
+
+type FixturePage struct {
+	Chats                 []FixtureChat `json:"chats"`
+	NextPageToken         string        `json:"nextPageToken"`
+	PollingIntervalMillis int64         `json:"pollingIntervalMillis"`
+	OfflineAt             time.Time     `json:"offlineAt"`
+}
+
+type FixtureChat struct {
+	ID              string `json:"id,omitempty"`
+	AuthorChannelID string `json:"authorChannelId"`
+	Message         string `json:"message"`
+	MessageType     string `json:"messageType,omitempty"`
+	PublishedAtUnix int64  `json:"publishedAtUnix"`
+}
+
+// ReplayChatSource returns the pages of a recorded fixture in order.
+// A page token of the fixture leads to the page recorded after it.
+type ReplayChatSource struct {
+	fixture ChatFixture
+}
+
+func NewReplayChatSource(fixture ChatFixture) *ReplayChatSource {
+	return &ReplayChatSource{fixture: fixture}
+}
+
+func LoadReplayChatSource(path string) (*ReplayChatSource, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fixture ChatFixture
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse chat fixture %s: %w", path, err)
+	}
+	return NewReplayChatSource(fixture), nil
+}
+
+func (s *ReplayChatSource) FetchChats(ctx context.Context, video VideoInfo, pageToken string) ([]Chat, ChatCursor, error) {
+	pages, ok := s.fixture[video.ChatID]
+	if !ok || len(pages) == 0 {
+		return nil, ChatCursor{}, fmt.Errorf("no fixture for chat %s", video.ChatID)
+	}
+
+	idx := 0
+	if pageToken != "" {
+		idx = -1
+		for i, page := range pages {
+			if page.NextPageToken == pageToken {
+				idx = i + 1
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, ChatCursor{}, fmt.Errorf("unknown page token %s for chat %s", pageToken, video.ChatID)
+		}
+	}
+	// After the last page, no new chats are returned as the API does
+	if idx >= len(pages) {
+		last := pages[len(pages)-1]
+		return nil, ChatCursor{
+			NextPageToken:   pageToken,
+			PollingInterval: time.Duration(last.PollingIntervalMillis) * time.Millisecond,
+			OfflineAt:       last.OfflineAt,
+		}, nil
+	}
+
+	page := pages[idx]
+	chats := make([]Chat, 0, len(page.Chats))
+	for _, chat := range page.Chats {
+		chats = append(chats, Chat{
+			ID:              chat.ID,
+			AuthorChannelID: chat.AuthorChannelID,
+			Message:         chat.Message,
+			MessageType:     chat.MessageType,
+			PublishedAtUnix: chat.PublishedAtUnix,
+			SourceID:        video.SourceID,
+		})
+	}
+
+	return chats, ChatCursor{
+		NextPageToken:   page.NextPageToken,
+		PollingInterval: time.Duration(page.PollingIntervalMillis) * time.Millisecond,
+		OfflineAt:       page.OfflineAt,
+	}, nil
+}
+
+// RecordingChatSource records the responses of another source to a fixture file for ReplayChatSource
+type RecordingChatSource struct {
+	source ChatSource
+	path   string
+
+	mu      sync.Mutex
+	fixture ChatFixture
+}
+
+func NewRecordingChatSource(source ChatSource, path string) *RecordingChatSource {
+	return &RecordingChatSource{
+		source:  source,
+		path:    path,
+		fixture: make(ChatFixture),
+	}
+}
+
+func (s *RecordingChatSource) FetchChats(ctx context.Context, video VideoInfo, pageToken string) ([]Chat, ChatCursor, error) {
+	chats, cursor, err := s.source.FetchChats(ctx, video, pageToken)
+	if err != nil {
+		return nil, ChatCursor{}, err
+	}
+
+	page := FixturePage{
+		Chats:                 make([]FixtureChat, 0, len(chats)),
+		NextPageToken:         cursor.NextPageToken,
+		PollingIntervalMillis: cursor.PollingInterval.Milliseconds(),
+		OfflineAt:             cursor.OfflineAt,
+	}
+	for _, chat := range chats {
+		page.Chats = append(page.Chats, FixtureChat{
+			ID:              chat.ID,
+			AuthorChannelID: chat.AuthorChannelID,
+			Message:         chat.Message,
+			MessageType:     chat.MessageType,
+			PublishedAtUnix: chat.PublishedAtUnix,
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixture[video.ChatID] = append(s.fixture[video.ChatID], page)
+
+	// The fixture is rewritten on each fetch so that it is complete even if the process is killed
+	b, err := json.MarshalIndent(s.fixture, "", "  ")
+	if err != nil {
+		return nil, ChatCursor{}, err
+	}
+	if err := os.WriteFile(s.path, b, 0o644); err != nil {
+		slog.Error("Failed to write chat fixture",
+			slog.Group("fetchChat", "path", s.path, "error", err),
+		)
+		return nil, ChatCursor{}, err
+	}
+
+	return chats, cursor, nil
+}
+
+func (s *RecordingChatSource) Close() error {
+	closeChatSource(s.source)
+	return nil
+}
+
+// FakeChatSource is an in-memory chat source.
+// The chats pushed to a chat are returned once, in the order they were pushed.
+type FakeChatSource struct {
+	// PollingInterval is returned in every cursor
+	PollingInterval time.Duration
+	// Err is returned by FetchChats when it is set
+	Err error
+
+	mu      sync.Mutex
+	chats   map[string][]Chat
+	offline map[string]time.Time
+}
+
+func NewFakeChatSource() *FakeChatSource {
+	return &FakeChatSource{
+		chats:   make(map[string][]Chat),
+		offline: make(map[string]time.Time),
+	}
+}
+
+// Push appends chats to the chat of chatID
+func (s *FakeChatSource) Push(chatID string, chats ...Chat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chats[chatID] = append(s.chats[chatID], chats...)
+}
+
+// SetOffline makes the chat of chatID go offline at t
+func (s *FakeChatSource) SetOffline(chatID string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offline[chatID] = t
+}
+
+func (s *FakeChatSource) FetchChats(ctx context.Context, video VideoInfo, pageToken string) ([]Chat, ChatCursor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, ChatCursor{}, s.Err
+	}
+
+	// The page token is the number of chats already returned
+	var offset int
+	if pageToken != "" {
+		n, err := strconv.Atoi(pageToken)
+		if err != nil {
+			return nil, ChatCursor{}, fmt.Errorf("invalid page token: %s", pageToken)
+		}
+		offset = n
+	}
+	all := s.chats[video.ChatID]
+	if offset > len(all) {
+		offset = len(all)
+	}
+
+	chats := make([]Chat, 0, len(all)-offset)
+	for _, chat := range all[offset:] {
+		chat.SourceID = video.SourceID
+		chats = append(chats, chat)
+	}
+
+	return chats, ChatCursor{
+		NextPageToken:   strconv.Itoa(len(all)),
+		PollingInterval: s.PollingInterval,
+		OfflineAt:       s.offline[video.ChatID],
+	}, nil
+}
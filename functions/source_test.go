@@ -0,0 +1,62 @@
+package functions
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordingChatSourceReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	video := VideoInfo{SourceID: "video", ChatID: "chat"}
+	offline := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	fake := NewFakeChatSource()
+	fake.PollingInterval = time.Second
+	recorder := NewRecordingChatSource(fake, path)
+
+	fetch := func(source ChatSource, pageToken string) ([]Chat, ChatCursor) {
+		t.Helper()
+		chats, cursor, err := source.FetchChats(ctx, video, pageToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chats, cursor
+	}
+
+	fake.Push("chat", Chat{ID: "1", AuthorChannelID: "a", Message: "first", MessageType: "textMessageEvent", PublishedAtUnix: 1})
+	recorded1, cursor1 := fetch(recorder, "")
+	fake.Push("chat", Chat{ID: "2", AuthorChannelID: "b", Message: "second", MessageType: "superChatEvent", PublishedAtUnix: 2})
+	fake.SetOffline("chat", offline)
+	recorded2, cursor2 := fetch(recorder, cursor1.NextPageToken)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := LoadReplayChatSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed1, replayCursor1 := fetch(replay, "")
+	replayed2, replayCursor2 := fetch(replay, replayCursor1.NextPageToken)
+
+	if !reflect.DeepEqual(replayed1, recorded1) || !reflect.DeepEqual(replayed2, recorded2) {
+		t.Errorf("replayed chats = %v %v, want %v %v", replayed1, replayed2, recorded1, recorded2)
+	}
+	if replayCursor1 != cursor1 || !replayCursor2.OfflineAt.Equal(cursor2.OfflineAt) || replayCursor2.NextPageToken != cursor2.NextPageToken {
+		t.Errorf("replayed cursors = %+v %+v, want %+v %+v", replayCursor1, replayCursor2, cursor1, cursor2)
+	}
+
+	// After the last page, the replay returns no new chats
+	chats, cursor := fetch(replay, replayCursor2.NextPageToken)
+	if len(chats) != 0 || !cursor.OfflineAt.Equal(offline) {
+		t.Errorf("after the last page: chats = %v, cursor = %+v", chats, cursor)
+	}
+
+	if _, _, err := replay.FetchChats(ctx, VideoInfo{ChatID: "unknown"}, ""); err == nil {
+		t.Error("replay of an unknown chat succeeded")
+	}
+}
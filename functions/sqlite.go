@@ -0,0 +1,47 @@
+package functions
+
+import (
+	"context"
+	"database/sql"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/sqlitedialect"
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+// SQLiteRepository is the repository on a local SQLite file
+// so that the whole function can run without a Postgres server in development and tests.
+// The tables are created when the repository is opened.
+type SQLiteRepository struct {
+	bunRepository
+}
+
+// The statement timeout of cfg is not supported by SQLite.
+func NewSQLiteRepository(ctx context.Context, path string, cfg DBConfig) (*SQLiteRepository, error) {
+	sqldb, err := sql.Open(sqliteshim.ShimName, path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.applyPool(sqldb)
+	// SQLite allows only one writer at a time
+	sqldb.SetMaxOpenConns(1)
+
+	db := bun.NewDB(sqldb, sqlitedialect.New())
+
+	models := []any{
+		(*VideoRecord)(nil),
+		(*ChatRecord)(nil),
+		(*PollRecord)(nil),
+		(*RunRecord)(nil),
+		(*LeaseRecord)(nil),
+		(*ChatArchiveRecord)(nil),
+		(*OutboxRecord)(nil),
+	}
+	for _, model := range models {
+		if _, err := db.NewCreateTable().Model(model).IfNotExists().Exec(ctx); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+
+	return &SQLiteRepository{bunRepository{db: db}}, nil
+}
@@ -0,0 +1,163 @@
+package functions
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// SSEHandler streams the chats published by broker as Server-Sent Events.
+// The events are filtered by the queries sourceId (repeatable) and authorClass (target or other).
+// The ID of each saved target chat is its message ID, so a client reconnecting with Last-Event-ID
+// first receives the saved chats after that message. The other chats are never saved and have no ID,
+// so the client keeps the ID of the last saved chat.
+func SSEHandler(broker *Broker, repo ChatRepository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		values := r.URL.Query()
+		filter := ChatFilter{
+			SourceIDs:   values["sourceId"],
+			AuthorClass: values.Get("authorClass"),
+		}
+		if filter.AuthorClass != "" && filter.AuthorClass != AuthorClassTarget && filter.AuthorClass != AuthorClassOther {
+			http.Error(w, fmt.Sprintf("invalid authorClass: %s", filter.AuthorClass), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		// Only the target chats are saved, so only they are replayed.
+		// The replay runs before the subscription so that a long replay does not overflow the buffer of the subscription.
+		var last *ChatKey
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID != "" && filter.AuthorClass != AuthorClassOther {
+			record, err := repo.GetChatRecordByID(ctx, lastID)
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				// The message may have been purged, so the client just receives the live events
+				slog.Info("Unknown Last-Event-ID", slog.Group("sse", "lastEventId", lastID))
+			case err != nil:
+				slog.Error("Failed to get chat of Last-Event-ID",
+					slog.Group("sse", "lastEventId", lastID, slog.Group("database", "error", err)),
+				)
+				return
+			default:
+				last = &ChatKey{PublishedAt: record.PublishedAt, ID: record.ID}
+				if *last, err = replayChats(ctx, w, repo, filter, *last, nil); err != nil {
+					slog.Error("Failed to replay chats",
+						slog.Group("sse", "lastEventId", lastID, slog.Group("database", "error", err)),
+					)
+					return
+				}
+				flusher.Flush()
+			}
+		}
+
+		sub := broker.Subscribe(filter)
+		defer sub.Close()
+
+		// The chats saved between the replay and the subscription are caught up from the database.
+		// The chats saved after the subscription may be both caught up and published, so they are told apart by the ID.
+		var replayed map[string]bool
+		if last != nil {
+			replayed = make(map[string]bool)
+			if _, err := replayChats(ctx, w, repo, filter, *last, replayed); err != nil {
+				slog.Error("Failed to replay chats",
+					slog.Group("sse", "lastEventId", lastID, slog.Group("database", "error", err)),
+				)
+				return
+			}
+			flusher.Flush()
+		}
+
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case event, ok := <-sub.C:
+				if !ok {
+					// The client reconnects with Last-Event-ID and catches up from the database
+					if sub.Dropped() {
+						slog.Info("Dropped slow SSE client", slog.Group("sse", "remoteAddr", r.RemoteAddr))
+					}
+					return
+				}
+				// Skip the chats already sent by the catch-up
+				if event.AuthorClass == AuthorClassTarget && replayed[event.ID] {
+					delete(replayed, event.ID)
+					continue
+				}
+				if err := writeChatEvent(w, event); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+// replayChats writes the saved chats after key and returns the key of the last written chat.
+// The IDs of the written chats are added to sent unless it is nil.
+func replayChats(ctx context.Context, w http.ResponseWriter, repo ChatRepository, filter ChatFilter, key ChatKey, sent map[string]bool) (ChatKey, error) {
+	for {
+		records, err := repo.ListChatRecords(ctx, ChatQuery{
+			SourceIDs: filter.SourceIDs,
+			After:     &key,
+			Limit:     500,
+		})
+		if err != nil {
+			return key, err
+		}
+		for _, record := range records {
+			if err := writeChatEvent(w, ChatEvent{ChatRecord: record, AuthorClass: AuthorClassTarget}); err != nil {
+				return key, err
+			}
+			key = ChatKey{PublishedAt: record.PublishedAt, ID: record.ID}
+			if sent != nil {
+				sent[record.ID] = true
+			}
+		}
+		if len(records) < 500 {
+			return key, nil
+		}
+	}
+}
+
+func writeChatEvent(w http.ResponseWriter, event ChatEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	// Only the target chats are saved and can be resumed from
+	if event.AuthorClass == AuthorClassTarget && event.ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", event.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: chat\ndata: %s\n\n", data)
+	return err
+}
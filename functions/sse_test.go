@@ -0,0 +1,172 @@
+package functions
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listHookRepository calls the hooks around each ListChatRecords with the number of the call
+type listHookRepository struct {
+	ChatRepository
+	calls  atomic.Int32
+	before func(call int)
+	after  func(call int)
+}
+
+func (r *listHookRepository) ListChatRecords(ctx context.Context, query ChatQuery) ([]ChatRecord, error) {
+	call := int(r.calls.Add(1))
+	if r.before != nil {
+		r.before(call)
+	}
+	records, err := r.ChatRepository.ListChatRecords(ctx, query)
+	if r.after != nil {
+		r.after(call)
+	}
+	return records, err
+}
+
+// sseEvent is an event read from the stream
+type sseEvent struct {
+	id    string
+	event ChatEvent
+}
+
+// readSSEEvents reads the events until stop returns true
+func readSSEEvents(t *testing.T, resp *http.Response, stop func(events []sseEvent) bool) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &current.event); err != nil {
+				t.Fatal(err)
+			}
+		case line == "":
+			events = append(events, current)
+			current = sseEvent{}
+			if stop(events) {
+				return events
+			}
+		}
+	}
+	t.Fatalf("stream ended after %d events: %v", len(events), sc.Err())
+	return nil
+}
+
+func TestSSEHandlerReplayAndCatchUp(t *testing.T) {
+	ctx := context.Background()
+	base := newTestRepository(t)
+	broker := NewBroker()
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	chat := func(id string, sec int) ChatRecord {
+		return ChatRecord{ID: id, Message: id, SourceID: "video", PublishedAt: now.Add(time.Duration(sec) * time.Second)}
+	}
+	save := func(records ...ChatRecord) {
+		if err := base.InsertChatRecord(ctx, records); err != nil {
+			t.Error(err)
+		}
+		broker.Publish(newChatEvents(AuthorClassTarget, records)...)
+	}
+	if err := base.InsertChatRecord(ctx, []ChatRecord{chat("id1", 1), chat("id2", 2), chat("id3", 3)}); err != nil {
+		t.Fatal(err)
+	}
+
+	caughtUp := make(chan struct{})
+	repo := &listHookRepository{
+		ChatRepository: base,
+		// Saved after the replay and before the subscription, so only the catch-up sends it
+		after: func(call int) {
+			switch call {
+			case 1:
+				save(chat("gap", 4))
+			case 2:
+				close(caughtUp)
+			}
+		},
+		// Saved after the subscription, so it is both caught up and published
+		before: func(call int) {
+			if call == 2 {
+				save(chat("both", 5))
+			}
+		},
+	}
+	srv := httptest.NewServer(SSEHandler(broker, repo))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"?sourceId=video", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "id1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The live events are published after the query of the catch-up
+	go func() {
+		<-caughtUp
+		broker.Publish(ChatEvent{ChatRecord: ChatRecord{ID: "viewer", Message: "viewer", SourceID: "video"}, AuthorClass: AuthorClassOther})
+		save(chat("live", 6))
+	}()
+
+	events := readSSEEvents(t, resp, func(events []sseEvent) bool {
+		return events[len(events)-1].event.ID == "live"
+	})
+
+	var got []string
+	for _, e := range events {
+		got = append(got, e.event.ID+"/"+e.id)
+	}
+	want := []string{"id2/id2", "id3/id3", "gap/gap", "both/both", "viewer/", "live/live"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v, want %v (chat ID/event ID)", got, want)
+	}
+}
+
+func TestSSEHandlerReplayDoesNotOverflowBuffer(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	broker := NewBroker()
+	broker.BufferSize = 1
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	var records []ChatRecord
+	for i := 0; i < 20; i++ {
+		records = append(records, ChatRecord{ID: string(rune('a' + i)), Message: "m", SourceID: "video", PublishedAt: now.Add(time.Duration(i) * time.Second)})
+	}
+	if err := repo.InsertChatRecord(ctx, records); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(SSEHandler(broker, repo))
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	events := readSSEEvents(t, resp, func(events []sseEvent) bool { return len(events) == len(records)-1 })
+	if last := events[len(events)-1].id; last != records[len(records)-1].ID {
+		t.Errorf("last event = %s, want %s", last, records[len(records)-1].ID)
+	}
+}
@@ -0,0 +1,471 @@
+package functions
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/Code-Hex/synchro"
+	"github.com/Code-Hex/synchro/tz"
+	"github.com/KasumiMercury/patotta-stone-function-chat/wire"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultStreamTarget is the endpoint of the gRPC API of YouTube Data API
+	DefaultStreamTarget = "youtube.googleapis.com:443"
+
+	streamListMethod = "/youtube.api.v3.V3DataLiveChatMessageService/StreamList"
+)
+
+// StreamChatSource fetches the chats by liveChatMessages.streamList, the server-streaming variant of LiveChatMessages.List.
+// A stream is kept open for each live chat, and each FetchChats call returns the next response of the stream.
+// When the stream is broken, it is reopened from the page token of the last received response.
+type StreamChatSource struct {
+	conn   *grpc.ClientConn
+	apiKey string
+
+	// MaxRetries is the number of reconnections in a row before the error is returned to the caller
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the wait before each reconnection
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*chatStream
+}
+
+type chatStream struct {
+	results <-chan streamResult
+	cancel  context.CancelFunc
+}
+
+type streamResult struct {
+	resp streamListResponse
+	err  error
+}
+
+// NewStreamChatSource connects to target, which is DefaultStreamTarget except for tests against a local server.
+// When opts is empty, the connection is secured by TLS.
+func NewStreamChatSource(target string, apiKey string, opts ...grpc.DialOption) (*StreamChatSource, error) {
+	if len(opts) == 0 {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
+	}
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamChatSource{
+		conn:       conn,
+		apiKey:     apiKey,
+		MaxRetries: 5,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		streams:    make(map[string]*chatStream),
+	}, nil
+}
+
+// Close stops all streams and closes the connection
+func (s *StreamChatSource) Close() error {
+	s.mu.Lock()
+	for chatID, st := range s.streams {
+		st.cancel()
+		delete(s.streams, chatID)
+	}
+	s.mu.Unlock()
+
+	return s.conn.Close()
+}
+
+func (s *StreamChatSource) FetchChats(ctx context.Context, video VideoInfo, pageToken string) ([]Chat, ChatCursor, error) {
+	st := s.stream(video.ChatID, pageToken)
+
+	var res streamResult
+	var ok bool
+	select {
+	case <-ctx.Done():
+		return nil, ChatCursor{}, ctx.Err()
+	case res, ok = <-st.results:
+	}
+
+	// The stream is removed when it ends, so that the next call opens a new stream
+	if !ok || res.err != nil || res.resp.OfflineAt != "" {
+		s.remove(video.ChatID, st)
+	}
+	if !ok {
+		return nil, ChatCursor{}, fmt.Errorf("stream of chat %s is closed", video.ChatID)
+	}
+	if res.err != nil {
+		slog.Error(
+			"Failed to receive liveChatMessages.streamList",
+			slog.Group("fetchChat", "chatId", video.ChatID, slog.Group("YouTubeAPI", "error", res.err)),
+		)
+		return nil, ChatCursor{}, res.err
+	}
+
+	return convertStreamResponse(video, res.resp)
+}
+
+func (s *StreamChatSource) stream(chatID string, pageToken string) *chatStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st, ok := s.streams[chatID]; ok {
+		return st
+	}
+
+	// The stream lives longer than a single FetchChats call, so it is not bound to the context of the caller
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan streamResult)
+	st := &chatStream{results: results, cancel: cancel}
+	s.streams[chatID] = st
+	go s.run(ctx, chatID, pageToken, results)
+
+	return st
+}
+
+func (s *StreamChatSource) remove(chatID string, st *chatStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.streams[chatID] == st {
+		st.cancel()
+		delete(s.streams, chatID)
+	}
+}
+
+func (s *StreamChatSource) run(ctx context.Context, chatID string, pageToken string, results chan<- streamResult) {
+	defer close(results)
+
+	backoff := s.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.receive(ctx, chatID, &pageToken, results, func() {
+			// Reset the backoff once the stream delivers a response
+			attempt = 0
+			backoff = s.MinBackoff
+		})
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if !isRetryableStreamError(err) || attempt >= s.MaxRetries {
+			select {
+			case results <- streamResult{err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		slog.Info(
+			"Reconnecting liveChatMessages.streamList",
+			slog.Group("fetchChat", "chatId", chatID, "pageToken", pageToken, "attempt", attempt+1, slog.Group("YouTubeAPI", "error", err)),
+		)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+// receive opens a stream resuming from pageToken and delivers the responses until the stream ends.
+// It returns nil only when the chat went offline.
+func (s *StreamChatSource) receive(ctx context.Context, chatID string, pageToken *string, results chan<- streamResult, delivered func()) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-goog-api-key", s.apiKey)
+	desc := &grpc.StreamDesc{StreamName: "StreamList", ServerStreams: true}
+	stream, err := s.conn.NewStream(ctx, desc, streamListMethod, grpc.ForceCodec(streamListCodec{}))
+	if err != nil {
+		return err
+	}
+
+	req := &streamListRequest{
+		LiveChatID: chatID,
+		PageToken:  *pageToken,
+		Part:       []string{"snippet"},
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		var resp streamListResponse
+		if err := stream.RecvMsg(&resp); err != nil {
+			return err
+		}
+		if resp.NextPageToken != "" {
+			*pageToken = resp.NextPageToken
+		}
+		delivered()
+
+		select {
+		case results <- streamResult{resp: resp}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if resp.OfflineAt != "" {
+			return nil
+		}
+	}
+}
+
+func isRetryableStreamError(err error) bool {
+	// The server may end the stream at any time, which is resumed by the page token
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Internal, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+func convertStreamResponse(video VideoInfo, resp streamListResponse) ([]Chat, ChatCursor, error) {
+	// The server pushes the responses, so no polling interval is requested
+	cursor := ChatCursor{NextPageToken: resp.NextPageToken}
+	if resp.OfflineAt != "" {
+		oa, err := synchro.ParseISO[tz.AsiaTokyo](resp.OfflineAt)
+		if err != nil {
+			slog.Error("Failed to parse offlineAt",
+				slog.Group("fetchChat", "chatID", video.ChatID, slog.Group("formatting", "error", err, "offlineAt", resp.OfflineAt)),
+			)
+			return nil, ChatCursor{}, err
+		}
+		cursor.OfflineAt = oa.StdTime()
+	}
+
+	result := make([]Chat, 0, len(resp.Items))
+	for _, item := range resp.Items {
+		pa, err := synchro.ParseISO[tz.AsiaTokyo](item.PublishedAt)
+		if err != nil {
+			slog.Error("Failed to parse publishedAt",
+				slog.Group("fetchChat", "chatID", video.ChatID, slog.Group("formatting", "error", err, "publishedAt", item.PublishedAt)),
+			)
+			return nil, ChatCursor{}, err
+		}
+		result = append(result, Chat{
+			ID:              item.ID,
+			AuthorChannelID: item.AuthorChannelID,
+			Message:         item.DisplayMessage,
+			MessageType:     streamMessageTypes[item.Type],
+			PublishedAtUnix: pa.Unix(),
+			SourceID:        video.SourceID,
+		})
+	}
+
+	return result, cursor, nil
+}
+
+// streamMessageTypes maps LiveChatMessageSnippet.TypeWrapper.Type to the type string of the REST API
+var streamMessageTypes = map[int32]string{
+	1:  "textMessageEvent",
+	2:  "tombstone",
+	3:  "fanFundingEvent",
+	4:  "chatEndedEvent",
+	5:  "sponsorOnlyModeStartedEvent",
+	6:  "sponsorOnlyModeEndedEvent",
+	7:  "newSponsorEvent",
+	8:  "messageDeletedEvent",
+	9:  "messageRetractedEvent",
+	10: "userBannedEvent",
+	15: "superChatEvent",
+	16: "superStickerEvent",
+	17: "memberMilestoneChatEvent",
+	18: "membershipGiftingEvent",
+	19: "giftMembershipReceivedEvent",
+}
+
+// The messages of streamList are encoded by hand with protowire
+// because only a few fields of proto/stream_list.proto are used.
+type streamListRequest struct {
+	LiveChatID string
+	MaxResults uint32
+	PageToken  string
+	Part       []string
+}
+
+type streamListResponse struct {
+	OfflineAt     string
+	NextPageToken string
+	Items         []streamChatMessage
+}
+
+type streamChatMessage struct {
+	ID              string
+	Type            int32
+	AuthorChannelID string
+	PublishedAt     string
+	DisplayMessage  string
+}
+
+func (r *streamListRequest) marshal() []byte {
+	var b []byte
+	if r.LiveChatID != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, r.LiveChatID)
+	}
+	if r.MaxResults != 0 {
+		b = protowire.AppendTag(b, 98, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.MaxResults))
+	}
+	if r.PageToken != "" {
+		b = protowire.AppendTag(b, 99, protowire.BytesType)
+		b = protowire.AppendString(b, r.PageToken)
+	}
+	for _, part := range r.Part {
+		b = protowire.AppendTag(b, 100, protowire.BytesType)
+		b = protowire.AppendString(b, part)
+	}
+	return b
+}
+
+func (r *streamListRequest) unmarshal(b []byte) error {
+	return wire.ConsumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			r.LiveChatID = string(v)
+		case num == 99 && typ == protowire.BytesType:
+			r.PageToken = string(v)
+		case num == 100 && typ == protowire.BytesType:
+			r.Part = append(r.Part, string(v))
+		case num == 98 && typ == protowire.VarintType:
+			n, _ := protowire.ConsumeVarint(v)
+			r.MaxResults = uint32(n)
+		}
+		return nil
+	})
+}
+
+func (r *streamListResponse) marshal() []byte {
+	var b []byte
+	if r.OfflineAt != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, r.OfflineAt)
+	}
+	if r.NextPageToken != "" {
+		b = protowire.AppendTag(b, 100602, protowire.BytesType)
+		b = protowire.AppendString(b, r.NextPageToken)
+	}
+	for _, item := range r.Items {
+		var snippet []byte
+		if item.Type != 0 {
+			snippet = protowire.AppendTag(snippet, 1, protowire.VarintType)
+			snippet = protowire.AppendVarint(snippet, uint64(item.Type))
+		}
+		snippet = protowire.AppendTag(snippet, 301, protowire.BytesType)
+		snippet = protowire.AppendString(snippet, item.AuthorChannelID)
+		snippet = protowire.AppendTag(snippet, 4, protowire.BytesType)
+		snippet = protowire.AppendString(snippet, item.PublishedAt)
+		snippet = protowire.AppendTag(snippet, 16, protowire.BytesType)
+		snippet = protowire.AppendString(snippet, item.DisplayMessage)
+
+		var msg []byte
+		msg = protowire.AppendTag(msg, 101, protowire.BytesType)
+		msg = protowire.AppendString(msg, item.ID)
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, snippet)
+
+		b = protowire.AppendTag(b, 1007, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	return b
+}
+
+func (r *streamListResponse) unmarshal(b []byte) error {
+	return wire.ConsumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 2:
+			r.OfflineAt = string(v)
+		case 100602:
+			r.NextPageToken = string(v)
+		case 1007:
+			var item streamChatMessage
+			if err := item.unmarshal(v); err != nil {
+				return err
+			}
+			r.Items = append(r.Items, item)
+		}
+		return nil
+	})
+}
+
+func (m *streamChatMessage) unmarshal(b []byte) error {
+	return wire.ConsumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 101:
+			m.ID = string(v)
+		case 2:
+			return wire.ConsumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if num == 1 && typ == protowire.VarintType {
+					n, _ := protowire.ConsumeVarint(v)
+					m.Type = int32(n)
+					return nil
+				}
+				if typ != protowire.BytesType {
+					return nil
+				}
+				switch num {
+				case 301:
+					m.AuthorChannelID = string(v)
+				case 4:
+					m.PublishedAt = string(v)
+				case 16:
+					m.DisplayMessage = string(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// streamListCodec encodes the hand-written messages in the protobuf wire format
+type streamListCodec struct{}
+
+type streamListMessage interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+func (streamListCodec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(streamListMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return msg.marshal(), nil
+}
+
+func (streamListCodec) Unmarshal(data []byte, v any) error {
+	msg, ok := v.(streamListMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	return msg.unmarshal(data)
+}
+
+func (streamListCodec) Name() string {
+	return "proto"
+}
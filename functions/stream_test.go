@@ -0,0 +1,247 @@
+package functions
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamSession is the script of a StreamList call of fakeStreamServer
+type streamSession struct {
+	responses []streamListResponse
+	// err ends the call after the responses; nil ends it as the chat went offline
+	err error
+}
+
+// fakeStreamServer serves StreamList with the codec of StreamChatSource
+type fakeStreamServer struct {
+	mu       sync.Mutex
+	sessions []streamSession
+	requests []streamListRequest
+	apiKeys  []string
+}
+
+func (s *fakeStreamServer) streamList(_ any, stream grpc.ServerStream) error {
+	var req streamListRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	s.apiKeys = append(s.apiKeys, md.Get("x-goog-api-key")...)
+	if len(s.sessions) == 0 {
+		s.mu.Unlock()
+		return status.Error(codes.NotFound, "no session")
+	}
+	session := s.sessions[0]
+	s.sessions = s.sessions[1:]
+	s.mu.Unlock()
+
+	for _, resp := range session.responses {
+		if err := stream.SendMsg(&resp); err != nil {
+			return err
+		}
+	}
+	return session.err
+}
+
+func newFakeStreamSource(t *testing.T, server *fakeStreamServer) *StreamChatSource {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.ForceServerCodec(streamListCodec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "youtube.api.v3.V3DataLiveChatMessageService",
+		HandlerType: (*any)(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "StreamList",
+			Handler:       server.streamList,
+			ServerStreams: true,
+		}},
+	}, nil)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	source, err := NewStreamChatSource("bufnet", "test-key",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.MinBackoff = time.Millisecond
+	source.MaxBackoff = time.Millisecond
+	t.Cleanup(func() { _ = source.Close() })
+	return source
+}
+
+func streamMessage(id string, typ int32, published string) streamChatMessage {
+	return streamChatMessage{ID: id, Type: typ, AuthorChannelID: "author-" + id, PublishedAt: published, DisplayMessage: "message " + id}
+}
+
+func TestStreamListCodecRoundTrip(t *testing.T) {
+	req := streamListRequest{LiveChatID: "chat", MaxResults: 200, PageToken: "token", Part: []string{"id", "snippet"}}
+	var gotReq streamListRequest
+	if err := gotReq.unmarshal(req.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotReq, req) {
+		t.Errorf("request = %+v, want %+v", gotReq, req)
+	}
+
+	resp := streamListResponse{
+		OfflineAt:     "2024-04-01T13:00:00+09:00",
+		NextPageToken: "next",
+		Items: []streamChatMessage{
+			streamMessage("1", 1, "2024-04-01T12:00:00+09:00"),
+			streamMessage("2", 15, "2024-04-01T12:00:01+09:00"),
+		},
+	}
+	var gotResp streamListResponse
+	if err := gotResp.unmarshal(resp.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotResp, resp) {
+		t.Errorf("response = %+v, want %+v", gotResp, resp)
+	}
+}
+
+func TestStreamChatSourceResumesFromPageToken(t *testing.T) {
+	server := &fakeStreamServer{sessions: []streamSession{
+		{
+			responses: []streamListResponse{
+				{NextPageToken: "p1", Items: []streamChatMessage{streamMessage("1", 1, "2024-04-01T12:00:00+09:00")}},
+				{NextPageToken: "p2", Items: []streamChatMessage{streamMessage("2", 15, "2024-04-01T12:00:01+09:00")}},
+			},
+			// The server breaks the stream, which is resumed from p2
+			err: status.Error(codes.Unavailable, "stream reset"),
+		},
+		{
+			responses: []streamListResponse{
+				{
+					NextPageToken: "p3",
+					OfflineAt:     "2024-04-01T13:00:00+09:00",
+					Items:         []streamChatMessage{streamMessage("3", 1, "2024-04-01T12:59:59+09:00")},
+				},
+			},
+		},
+	}}
+	source := newFakeStreamSource(t, server)
+	video := VideoInfo{SourceID: "video", ChatID: "chat"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var ids []string
+	var types []string
+	var cursor ChatCursor
+	for cursor.OfflineAt.IsZero() {
+		chats, next, err := source.FetchChats(ctx, video, cursor.NextPageToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chat := range chats {
+			if chat.SourceID != "video" {
+				t.Errorf("source ID of chat %s = %q", chat.ID, chat.SourceID)
+			}
+			ids = append(ids, chat.ID)
+			types = append(types, chat.MessageType)
+		}
+		cursor = next
+	}
+
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("chat IDs = %v, want %v", ids, want)
+	}
+	if want := []string{"textMessageEvent", "superChatEvent", "textMessageEvent"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("message types = %v, want %v", types, want)
+	}
+	if cursor.NextPageToken != "p3" {
+		t.Errorf("next page token = %q, want p3", cursor.NextPageToken)
+	}
+	if want := time.Date(2024, 4, 1, 4, 0, 0, 0, time.UTC); !cursor.OfflineAt.Equal(want) {
+		t.Errorf("offlineAt = %s, want %s", cursor.OfflineAt, want)
+	}
+	if cursor.PollingInterval != 0 {
+		t.Errorf("polling interval = %s, want 0", cursor.PollingInterval)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	var tokens []string
+	for _, req := range server.requests {
+		if req.LiveChatID != "chat" || !reflect.DeepEqual(req.Part, []string{"snippet"}) {
+			t.Errorf("request = %+v", req)
+		}
+		tokens = append(tokens, req.PageToken)
+	}
+	if want := []string{"", "p2"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("page tokens = %q, want %q", tokens, want)
+	}
+	if want := []string{"test-key", "test-key"}; !reflect.DeepEqual(server.apiKeys, want) {
+		t.Errorf("api keys = %v, want %v", server.apiKeys, want)
+	}
+
+	// The stream of the offline chat is closed
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if len(source.streams) != 0 {
+		t.Errorf("streams = %d after offline, want 0", len(source.streams))
+	}
+}
+
+func TestStreamChatSourceReturnsPermanentError(t *testing.T) {
+	server := &fakeStreamServer{sessions: []streamSession{
+		{err: status.Error(codes.PermissionDenied, "quota")},
+	}}
+	source := newFakeStreamSource(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, _, err := source.FetchChats(ctx, VideoInfo{SourceID: "video", ChatID: "chat"}, "")
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("error = %v, want PermissionDenied", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.requests) != 1 {
+		t.Errorf("requests = %d, want 1 without retries", len(server.requests))
+	}
+}
+
+func TestStreamChatSourceGivesUpAfterMaxRetries(t *testing.T) {
+	server := &fakeStreamServer{}
+	for i := 0; i < 3; i++ {
+		server.sessions = append(server.sessions, streamSession{err: status.Error(codes.Unavailable, "down")})
+	}
+	source := newFakeStreamSource(t, server)
+	source.MaxRetries = 2
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, _, err := source.FetchChats(ctx, VideoInfo{SourceID: "video", ChatID: "chat"}, "token")
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("error = %v, want Unavailable", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.requests) != 3 {
+		t.Errorf("requests = %d, want 3", len(server.requests))
+	}
+	for _, req := range server.requests {
+		if req.PageToken != "token" {
+			t.Errorf("page token = %q, want token", req.PageToken)
+		}
+	}
+}
@@ -28,9 +28,14 @@ func InitTracing() (*trace.TracerProvider, error) {
 		}
 	}
 
-	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
-	if projectID == "" {
-		panic("GOOGLE_CLOUD_PROJECT must be set")
+	// Without the project, such as in the tests and the commands run locally,
+	// the spans are recorded but not exported
+	if os.Getenv("GOOGLE_CLOUD_PROJECT") == "" {
+		slog.Warn("GOOGLE_CLOUD_PROJECT is not set, traces are not exported")
+		tp := trace.NewTracerProvider()
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		return tp, nil
 	}
 	appName := os.Getenv("NAME")
 	if appName == "" {
@@ -0,0 +1,384 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Watcher runs the chat pipeline continuously instead of on each tick of Cloud Scheduler.
+// A loop is started for each live chat and polls the chat at the interval requested by the API.
+// The chats of the targets are buffered and inserted to the database periodically.
+type Watcher struct {
+	source ChatSource
+	repo   ChatRepository
+	target []string
+
+	// RefreshInterval is the interval to look up the live videos in the database
+	RefreshInterval time.Duration
+	// FlushInterval is the interval to insert the pending chats to the database
+	FlushInterval time.Duration
+	// RetryInterval is the wait before the next fetch after a failure
+	RetryInterval time.Duration
+	// MinPollInterval is used when the API requests a shorter polling interval, except for the streaming source
+	MinPollInterval time.Duration
+	// Dispatcher delivers the chats routed to its sinks after each flush (nil disables the delivery)
+	Dispatcher *OutboxDispatcher
+	// Broker receives the target chats when they are inserted and the other chats when they are fetched (nil disables it)
+	Broker *Broker
+	// MaxPending is the number of the buffered chats at which the loops stop fetching until a flush succeeds
+	MaxPending int
+	// MaxCommitAttempts is the number of the failed flushes of a video, while the database is reachable,
+	// after which its chats are committed one by one and the failing ones are dead-lettered to the log
+	MaxCommitAttempts int
+
+	mu      sync.Mutex
+	pending RunWrites
+	// failures is the number of the consecutive failed commits of each video
+	failures map[string]int
+	loops    map[string]context.CancelFunc
+	wg       sync.WaitGroup
+
+	ready atomic.Bool
+}
+
+func NewWatcher(source ChatSource, repo ChatRepository, target []string) *Watcher {
+	return &Watcher{
+		source:            source,
+		repo:              repo,
+		target:            target,
+		RefreshInterval:   time.Minute,
+		FlushInterval:     10 * time.Second,
+		RetryInterval:     5 * time.Second,
+		MinPollInterval:   time.Second,
+		MaxPending:        10000,
+		MaxCommitAttempts: 3,
+		failures:          make(map[string]int),
+		loops:             make(map[string]context.CancelFunc),
+	}
+}
+
+// Run blocks until ctx is canceled.
+// On cancellation, all loops are stopped and the pending chats are flushed before returning.
+func (w *Watcher) Run(ctx context.Context) error {
+	refresh := time.NewTicker(w.RefreshInterval)
+	defer refresh.Stop()
+	flush := time.NewTicker(w.FlushInterval)
+	defer flush.Stop()
+
+	w.refresh(ctx)
+	w.ready.Store(true)
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.ready.Store(false)
+			w.stopLoops()
+
+			// Flush the pending chats with a fresh context because ctx is already canceled
+			flushCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			slog.Info("Flushing pending chats before shutdown")
+			return w.flush(flushCtx)
+		case <-refresh.C:
+			w.refresh(ctx)
+		case <-flush.C:
+			// Failed chats are kept in the buffer and retried at the next flush
+			_ = w.flush(ctx)
+		}
+	}
+}
+
+// HealthHandler serves /healthz for liveness and /readyz for readiness
+func (w *Watcher) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, r *http.Request) {
+		if !w.ready.Load() {
+			http.Error(rw, "watcher is not running", http.StatusServiceUnavailable)
+			return
+		}
+		if err := w.repo.Ping(r.Context()); err != nil {
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+func (w *Watcher) refresh(ctx context.Context) {
+	videoRecords, err := w.repo.GetVideoRecordByStatus(ctx, []string{"live"})
+	if err != nil {
+		slog.Error("Failed to get video records",
+			slog.Group("watcher", slog.Group("database", "error", err)),
+		)
+		return
+	}
+
+	live := make(map[string]VideoInfo, len(videoRecords))
+	for _, video := range videoRecords {
+		live[video.SourceID] = VideoInfo{
+			ChatID:   video.ChatID,
+			SourceID: video.SourceID,
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Stop the loops of the videos that are no longer live
+	for sourceID, cancel := range w.loops {
+		if _, ok := live[sourceID]; !ok {
+			cancel()
+			delete(w.loops, sourceID)
+		}
+	}
+
+	// Start the loops of the videos that became live
+	for sourceID, video := range live {
+		if _, ok := w.loops[sourceID]; ok {
+			continue
+		}
+		loopCtx, cancel := context.WithCancel(ctx)
+		w.loops[sourceID] = cancel
+		w.wg.Add(1)
+		go func(video VideoInfo) {
+			defer w.wg.Done()
+			w.watchChat(loopCtx, video)
+		}(video)
+		slog.Info("Start watching live chat",
+			slog.Group("watcher", "chatId", video.ChatID, "sourceId", video.SourceID),
+		)
+	}
+}
+
+func (w *Watcher) stopLoops() {
+	w.mu.Lock()
+	for sourceID, cancel := range w.loops {
+		cancel()
+		delete(w.loops, sourceID)
+	}
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
+
+func (w *Watcher) watchChat(ctx context.Context, video VideoInfo) {
+	// Resume after the last saved chat so that a restart does not insert the same chats again
+	var threshold int64
+	pldRec, err := w.repo.GetLastPublishedAtOfRecordEachSource(ctx, []string{video.SourceID})
+	if err != nil {
+		slog.Error("Failed to get last publishedAt of record",
+			slog.Group("watcher", "sourceId", video.SourceID, slog.Group("database", "error", err)),
+		)
+	} else {
+		threshold = pldRec[video.SourceID]
+	}
+
+	streaming := isStreamingSource(w.source)
+	var pageToken string
+	for {
+		// The page token keeps the position in the chat while the buffer is full
+		if w.isFull() {
+			slog.Warn("Pending chats are full, waiting for the flush",
+				slog.Group("watcher", "chatId", video.ChatID, "maxPending", w.MaxPending),
+			)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.RetryInterval):
+			}
+			continue
+		}
+
+		chats, cursor, err := w.source.FetchChats(ctx, video, pageToken)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Failed to fetch chats from YouTube API",
+				slog.Group("watcher", "chatId", video.ChatID, "error", err),
+			)
+			cursor.PollingInterval = w.RetryInterval
+		} else {
+			pageToken = cursor.NextPageToken
+
+			// The threshold is used only for the first page
+			// After that, the page token returns only new chats
+			if threshold != 0 {
+				chats = filterChatsByPublishedAt(chats, threshold)
+				threshold = 0
+			}
+			targetChats, otherChats := separateChatsByAuthor(chats, w.target)
+			otherEvents := newChatEvents(AuthorClassOther, convertChatsToRecords(otherChats))
+			w.enqueue(video, cursor, convertChatsToRecords(targetChats), otherEvents)
+			w.publish(otherEvents)
+
+			// The chat that went offline no longer returns new chats
+			if !cursor.OfflineAt.IsZero() {
+				slog.Info("Stop watching offline chat",
+					slog.Group("watcher", "chatId", video.ChatID, "offlineAt", cursor.OfflineAt),
+				)
+				return
+			}
+		}
+
+		// The streaming source requests no interval because it blocks until the next chats arrive
+		interval := cursor.PollingInterval
+		if interval < w.MinPollInterval && !streaming {
+			interval = w.MinPollInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (w *Watcher) isFull() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.MaxPending > 0 && len(w.pending.Chats) >= w.MaxPending
+}
+
+func (w *Watcher) enqueue(video VideoInfo, cursor ChatCursor, records []ChatRecord, others []ChatEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending.AddPoll(video, cursor, time.Now())
+	w.pending.AddChats(records)
+	if w.Dispatcher != nil {
+		events := append(newChatEvents(AuthorClassTarget, records), others...)
+		if err := w.pending.RouteOutbox(w.Dispatcher.Sinks(), events, time.Now()); err != nil {
+			slog.Error("Failed to queue chats for sinks",
+				slog.Group("watcher", "chatId", video.ChatID, slog.Group("outbox", "error", err)),
+			)
+		}
+	}
+}
+
+// flush commits the pending chats and poll states in a single transaction,
+// then delivers the outbox including the batches failed in the previous flushes
+func (w *Watcher) flush(ctx context.Context) error {
+	if err := w.commit(ctx); err != nil {
+		return err
+	}
+
+	// The delivery does not block the loops enqueueing the chats
+	if w.Dispatcher != nil {
+		if _, err := w.Dispatcher.Drain(ctx); err != nil {
+			slog.Error("Failed to deliver outbox",
+				slog.Group("watcher", slog.Group("outbox", "error", err)),
+			)
+		}
+	}
+
+	return nil
+}
+
+func (w *Watcher) commit(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pending.IsEmpty() {
+		return nil
+	}
+
+	records := w.pending.Chats
+	_, err := w.pending.Commit(ctx, w.repo)
+	if err == nil {
+		clear(w.failures)
+		// The target chats are published only after they are saved so that the subscribers can resume from the database
+		w.publish(newChatEvents(AuthorClassTarget, records))
+		return nil
+	}
+
+	// A failure caused by a row of a video must not block the other videos
+	return w.commitEachSource(ctx)
+}
+
+// commitEachSource commits the writes of each video in its own transaction.
+// Failed writes are kept in the buffer to be retried at the next flush,
+// unless the video has failed MaxCommitAttempts times while the database is reachable.
+func (w *Watcher) commitEachSource(ctx context.Context) error {
+	// The failures during an outage of the database are not caused by the rows
+	reachable := w.repo.Ping(ctx) == nil
+
+	var remaining RunWrites
+	var errs []error
+	for _, writes := range w.pending.bySource() {
+		sourceID := sourceOfWrites(writes)
+		records := writes.Chats
+		_, err := writes.Commit(ctx, w.repo)
+		if err == nil {
+			delete(w.failures, sourceID)
+			w.publish(newChatEvents(AuthorClassTarget, records))
+			continue
+		}
+		errs = append(errs, err)
+
+		if reachable {
+			w.failures[sourceID]++
+		}
+		if w.MaxCommitAttempts > 0 && w.failures[sourceID] >= w.MaxCommitAttempts {
+			delete(w.failures, sourceID)
+			w.deadLetter(ctx, sourceID, writes)
+			continue
+		}
+		remaining.Chats = append(remaining.Chats, writes.Chats...)
+		remaining.Polls = append(remaining.Polls, writes.Polls...)
+		remaining.Outbox = append(remaining.Outbox, writes.Outbox...)
+	}
+	w.pending = remaining
+
+	return errors.Join(errs...)
+}
+
+// deadLetter commits the poll states and the outbox of the video without the chats, then the chats one by one.
+// The writes that still fail are logged with their contents and dropped from the buffer.
+func (w *Watcher) deadLetter(ctx context.Context, sourceID string, writes RunWrites) {
+	state := RunWrites{Polls: writes.Polls, Outbox: writes.Outbox}
+	if _, err := state.Commit(ctx, w.repo); err != nil {
+		slog.Error("Dropped poll state and outbox after failed commits",
+			slog.Group("watcher", "sourceId", sourceID, "polls", writes.Polls, "outbox", len(writes.Outbox), slog.Group("database", "error", err)),
+		)
+	}
+
+	for _, record := range writes.Chats {
+		single := RunWrites{Chats: []ChatRecord{record}}
+		if _, err := single.Commit(ctx, w.repo); err != nil {
+			slog.Error("Dropped chat after failed commits",
+				slog.Group("watcher", "sourceId", sourceID, "chat", record, slog.Group("database", "error", err)),
+			)
+			continue
+		}
+		w.publish(newChatEvents(AuthorClassTarget, []ChatRecord{record}))
+	}
+}
+
+// sourceOfWrites returns the source ID of the writes of a single video
+func sourceOfWrites(writes RunWrites) string {
+	switch {
+	case len(writes.Polls) != 0:
+		return writes.Polls[0].SourceID
+	case len(writes.Chats) != 0:
+		return writes.Chats[0].SourceID
+	case len(writes.Outbox) != 0:
+		return writes.Outbox[0].SourceID
+	}
+	return ""
+}
+
+func (w *Watcher) publish(events []ChatEvent) {
+	if w.Broker == nil {
+		return
+	}
+	w.Broker.Publish(events...)
+}
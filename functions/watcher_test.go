@@ -0,0 +1,198 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// poisonRepository fails the insertion of the chats containing the poison message
+type poisonRepository struct {
+	ChatRepository
+	poison string
+}
+
+func (r *poisonRepository) InsertChatRecord(ctx context.Context, records []ChatRecord) error {
+	for _, record := range records {
+		if record.Message == r.poison {
+			return errors.New("poison chat")
+		}
+	}
+	return r.ChatRepository.InsertChatRecord(ctx, records)
+}
+
+func (r *poisonRepository) RunInTx(ctx context.Context, fn func(ctx context.Context, repo ChatRepository) error) error {
+	return r.ChatRepository.RunInTx(ctx, func(ctx context.Context, tx ChatRepository) error {
+		return fn(ctx, &poisonRepository{ChatRepository: tx, poison: r.poison})
+	})
+}
+
+func storedMessages(t *testing.T, repo ChatRepository, sourceID string) []string {
+	t.Helper()
+	records, err := repo.ListChatRecords(context.Background(), ChatQuery{SourceIDs: []string{sourceID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, record := range records {
+		messages = append(messages, record.Message)
+	}
+	slices.Sort(messages)
+	return messages
+}
+
+func TestWatcherFlushDeadLettersPoisonChat(t *testing.T) {
+	ctx := context.Background()
+	base := newTestRepository(t)
+	repo := &poisonRepository{ChatRepository: base, poison: "poison"}
+	w := NewWatcher(NewFakeChatSource(), repo, nil)
+	now := time.Now().Truncate(time.Second)
+
+	healthy := VideoInfo{SourceID: "healthy", ChatID: "chat-healthy"}
+	broken := VideoInfo{SourceID: "broken", ChatID: "chat-broken"}
+	w.enqueue(broken, ChatCursor{}, []ChatRecord{
+		{ID: "b1", Message: "fine", SourceID: "broken", PublishedAt: now},
+		{ID: "b2", Message: "poison", SourceID: "broken", PublishedAt: now.Add(time.Second)},
+	}, nil)
+	w.enqueue(healthy, ChatCursor{}, []ChatRecord{
+		{ID: "h1", Message: "hello", SourceID: "healthy", PublishedAt: now},
+	}, nil)
+
+	// The healthy video is committed on its own while the broken one is retried
+	if err := w.flush(ctx); err == nil {
+		t.Fatal("flush succeeded with a poison chat")
+	}
+	if got := storedMessages(t, base, "healthy"); !slices.Equal(got, []string{"hello"}) {
+		t.Errorf("healthy chats = %v", got)
+	}
+	if got := storedMessages(t, base, "broken"); len(got) != 0 {
+		t.Errorf("broken chats = %v before the dead-lettering", got)
+	}
+	if len(w.pending.Chats) != 2 {
+		t.Fatalf("pending chats = %d, want 2", len(w.pending.Chats))
+	}
+
+	for i := 1; i < w.MaxCommitAttempts; i++ {
+		_ = w.flush(ctx)
+	}
+
+	// Only the poison chat is dropped after the maximum attempts
+	if got := storedMessages(t, base, "broken"); !slices.Equal(got, []string{"fine"}) {
+		t.Errorf("broken chats = %v, want [fine]", got)
+	}
+	if !w.pending.IsEmpty() {
+		t.Errorf("pending = %+v, want empty", w.pending)
+	}
+	polls, err := base.GetPollRecordEachSource(ctx, []string{"broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := polls["broken"]; !ok {
+		t.Error("poll state of the broken video was not committed")
+	}
+}
+
+func TestWatcherIsFull(t *testing.T) {
+	w := NewWatcher(NewFakeChatSource(), newTestRepository(t), nil)
+	w.MaxPending = 2
+	video := VideoInfo{SourceID: "s", ChatID: "c"}
+
+	w.enqueue(video, ChatCursor{}, []ChatRecord{{ID: "1", Message: "1", SourceID: "s"}}, nil)
+	if w.isFull() {
+		t.Error("full with 1 chat")
+	}
+	w.enqueue(video, ChatCursor{}, []ChatRecord{{ID: "2", Message: "2", SourceID: "s"}}, nil)
+	if !w.isFull() {
+		t.Error("not full with 2 chats")
+	}
+	if err := w.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w.isFull() {
+		t.Error("full after the flush")
+	}
+}
+
+// countingSource counts the fetches of the wrapped source
+type countingSource struct {
+	ChatSource
+	fetches atomic.Int32
+}
+
+func (s *countingSource) FetchChats(ctx context.Context, video VideoInfo, pageToken string) ([]Chat, ChatCursor, error) {
+	s.fetches.Add(1)
+	return s.ChatSource.FetchChats(ctx, video, pageToken)
+}
+
+func TestWatcherRun(t *testing.T) {
+	repo := newTestRepository(t)
+	now := time.Now().Truncate(time.Second)
+	insertVideos(t, repo,
+		VideoRecord{SourceID: "live", Status: "live", ChatID: "chat-live", UpdatedAt: now},
+		VideoRecord{SourceID: "ended", Status: "live", ChatID: "chat-ended", UpdatedAt: now},
+	)
+
+	source := NewFakeChatSource()
+	source.Push("chat-live",
+		Chat{ID: "1", AuthorChannelID: "target", Message: "from target", PublishedAtUnix: now.Unix()},
+		Chat{ID: "2", AuthorChannelID: "viewer", Message: "from viewer", PublishedAtUnix: now.Unix()},
+	)
+	source.SetOffline("chat-ended", now)
+
+	w := NewWatcher(source, repo, []string{"target"})
+	w.RefreshInterval = 10 * time.Millisecond
+	w.FlushInterval = 10 * time.Millisecond
+	w.MinPollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+
+	waitFor(t, func() bool { return len(storedMessages(t, repo, "live")) == 1 })
+	// A chat pushed later is fetched from the page token of the previous fetch
+	source.Push("chat-live", Chat{ID: "3", AuthorChannelID: "target", Message: "again", PublishedAtUnix: now.Unix() + 1})
+	waitFor(t, func() bool { return len(storedMessages(t, repo, "live")) == 2 })
+	waitFor(t, func() bool {
+		videos, err := repo.GetVideoRecordEachSource(context.Background(), []string{"ended"})
+		return err == nil && videos["ended"].Status == VideoStatusClosed
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := storedMessages(t, repo, "live"); !slices.Equal(got, []string{"again", "from target"}) {
+		t.Errorf("stored chats = %v, want only the target chats", got)
+	}
+	polls, err := repo.GetPollRecordEachSource(context.Background(), []string{"live", "ended"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polls["live"].LastPolledAt.IsZero() || polls["ended"].OfflineAt.IsZero() {
+		t.Errorf("polls = %+v", polls)
+	}
+}
+
+func TestWatcherMinPollInterval(t *testing.T) {
+	repo := newTestRepository(t)
+	insertVideos(t, repo, VideoRecord{SourceID: "live", Status: "live", ChatID: "chat-live", UpdatedAt: time.Now()})
+
+	// The fake requests no polling interval at all
+	source := &countingSource{ChatSource: NewFakeChatSource()}
+	w := NewWatcher(source, repo, nil)
+	w.MinPollInterval = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := w.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := source.fetches.Load(); n < 2 || n > 8 {
+		t.Errorf("fetches = %d in 300ms with the minimum interval of 50ms", n)
+	}
+}
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS videos_status_idx;
+
+ALTER TABLE videos DROP COLUMN IF EXISTS scheduled_at;
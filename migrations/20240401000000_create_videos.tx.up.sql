@@ -0,0 +1,12 @@
+-- The videos table is maintained by the other services, so it is created only when it does not exist yet.
+CREATE TABLE IF NOT EXISTS videos (
+    source_id    varchar(255) PRIMARY KEY,
+    status       varchar(255) NOT NULL,
+    chat_id      varchar(255) NOT NULL DEFAULT '',
+    scheduled_at timestamptz,
+    updated_at   timestamptz  NOT NULL DEFAULT now()
+);
+
+ALTER TABLE videos ADD COLUMN IF NOT EXISTS scheduled_at timestamptz;
+
+CREATE INDEX IF NOT EXISTS videos_status_idx ON videos (status);
@@ -0,0 +1,5 @@
+-- The chats were saved before the migrations, so the table is kept and only the changes of the up migration are undone.
+DROP INDEX IF EXISTS chats_source_id_published_at_idx;
+
+-- The timestamps are written back in UTC. is_negative stays boolean, as tinyint(1) is not a type of Postgres.
+ALTER TABLE chats ALTER COLUMN published_at TYPE timestamp USING published_at AT TIME ZONE 'UTC';
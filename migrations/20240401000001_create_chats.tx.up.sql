@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS chats (
+    message      varchar(255) PRIMARY KEY,
+    is_negative  boolean      NOT NULL DEFAULT false,
+    source_id    varchar(255) NOT NULL,
+    published_at timestamptz  NOT NULL
+);
+
+-- The tables created before the migrations may have the types of MySQL (tinyint(1)) or timestamps without time zone.
+-- The timestamps were written in UTC.
+DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_name = 'chats' AND column_name = 'is_negative') <> 'boolean' THEN
+        ALTER TABLE chats ALTER COLUMN is_negative DROP DEFAULT;
+        ALTER TABLE chats ALTER COLUMN is_negative TYPE boolean USING is_negative::int <> 0;
+        ALTER TABLE chats ALTER COLUMN is_negative SET DEFAULT false;
+    END IF;
+
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_name = 'chats' AND column_name = 'published_at') = 'timestamp without time zone' THEN
+        ALTER TABLE chats ALTER COLUMN published_at TYPE timestamptz USING published_at AT TIME ZONE 'UTC';
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS chats_source_id_published_at_idx ON chats (source_id, published_at);
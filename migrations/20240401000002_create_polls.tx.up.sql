@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS polls (
+    source_id               varchar(255) PRIMARY KEY,
+    chat_id                 varchar(255) NOT NULL DEFAULT '',
+    last_polled_at          timestamptz  NOT NULL,
+    next_poll_at            timestamptz,
+    polling_interval_millis bigint       NOT NULL DEFAULT 0,
+    offline_at              timestamptz
+);
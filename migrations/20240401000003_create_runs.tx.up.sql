@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS runs (
+    id              bigserial   PRIMARY KEY,
+    started_at      timestamptz NOT NULL,
+    ended_at        timestamptz NOT NULL,
+    span            integer     NOT NULL,
+    mode            varchar(16) NOT NULL DEFAULT '',
+    video_ids       jsonb       NOT NULL DEFAULT '[]',
+    fetched         integer     NOT NULL DEFAULT 0,
+    filtered        integer     NOT NULL DEFAULT 0,
+    inserted        integer     NOT NULL DEFAULT 0,
+    api_calls       integer     NOT NULL DEFAULT 0,
+    sentiment_calls integer     NOT NULL DEFAULT 0,
+    error           text        NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS runs_started_at_idx ON runs (started_at);
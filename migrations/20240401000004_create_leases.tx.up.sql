@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS leases (
+    name       varchar(255) PRIMARY KEY,
+    holder     varchar(64)  NOT NULL,
+    expires_at timestamptz  NOT NULL
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS chat_archives (
+    id                 bigserial    PRIMARY KEY,
+    source_id          varchar(255) NOT NULL,
+    first_published_at timestamptz  NOT NULL,
+    last_published_at  timestamptz  NOT NULL,
+    count              integer      NOT NULL,
+    archived_at        timestamptz  NOT NULL,
+    payload            bytea        NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS chat_archives_source_id_idx ON chat_archives (source_id, first_published_at);
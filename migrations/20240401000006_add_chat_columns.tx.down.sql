@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS chats_author_channel_id_idx;
+DROP INDEX IF EXISTS chats_id_idx;
+
+ALTER TABLE chats DROP COLUMN IF EXISTS message_type;
+ALTER TABLE chats DROP COLUMN IF EXISTS author_channel_id;
+ALTER TABLE chats DROP COLUMN IF EXISTS id;
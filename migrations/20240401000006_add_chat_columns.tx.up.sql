@@ -0,0 +1,6 @@
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS id varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS author_channel_id varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS message_type varchar(64) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS chats_id_idx ON chats (id);
+CREATE INDEX IF NOT EXISTS chats_author_channel_id_idx ON chats (author_channel_id, published_at);
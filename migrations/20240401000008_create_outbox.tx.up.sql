@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id              bigserial    PRIMARY KEY,
+    source_id       varchar(255) NOT NULL,
+    batch_id        varchar(64)  NOT NULL UNIQUE,
+    payload         bytea        NOT NULL,
+    count           integer      NOT NULL DEFAULT 0,
+    status          varchar(16)  NOT NULL DEFAULT 'pending',
+    attempts        integer      NOT NULL DEFAULT 0,
+    last_error      text         NOT NULL DEFAULT '',
+    created_at      timestamptz  NOT NULL,
+    next_attempt_at timestamptz  NOT NULL,
+    delivered_at    timestamptz
+);
+
+-- The dispatcher reads only the pending batches
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (source_id, id) WHERE status = 'pending';
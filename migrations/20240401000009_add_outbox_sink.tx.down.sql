@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS outbox_pending_idx;
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (source_id, id) WHERE status = 'pending';
+
+ALTER TABLE outbox DROP COLUMN IF EXISTS sink;
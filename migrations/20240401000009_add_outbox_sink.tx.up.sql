@@ -0,0 +1,5 @@
+-- The batches queued before the sinks belong to the sink of EXTERNAL_SERVICE_URL
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS sink varchar(64) NOT NULL DEFAULT 'external';
+
+DROP INDEX IF EXISTS outbox_pending_idx;
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (sink, source_id, id) WHERE status = 'pending';
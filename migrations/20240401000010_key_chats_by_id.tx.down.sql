@@ -0,0 +1,7 @@
+CREATE INDEX IF NOT EXISTS chats_id_idx ON chats (id);
+
+-- This fails when the same message was saved twice after the up migration
+ALTER TABLE chats DROP CONSTRAINT IF EXISTS chats_pkey;
+ALTER TABLE chats ADD CONSTRAINT chats_pkey PRIMARY KEY (message);
+
+UPDATE chats SET id = '' WHERE id LIKE 'legacy:%';
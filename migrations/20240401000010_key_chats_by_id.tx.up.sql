@@ -0,0 +1,19 @@
+-- The message was the primary key, so the same text sent twice could not be saved.
+-- The chats saved before the ID column have no ID, and get one derived from the row. The same message may have been
+-- saved again after the ID column was added, so the source and the time are part of it, and the row number tells
+-- apart the rows that are still equal.
+UPDATE chats SET id = 'legacy:' || legacy.key
+FROM (
+    SELECT ctid,
+           md5(source_id || '/' || extract(epoch FROM published_at)::text || '/' || message)
+               || '-' || row_number() OVER (PARTITION BY source_id, published_at, message ORDER BY ctid) AS key
+    FROM chats
+    WHERE id = ''
+) AS legacy
+WHERE chats.ctid = legacy.ctid;
+
+ALTER TABLE chats DROP CONSTRAINT IF EXISTS chats_pkey;
+ALTER TABLE chats ADD CONSTRAINT chats_pkey PRIMARY KEY (id);
+
+-- The primary key replaces the index on the ID
+DROP INDEX IF EXISTS chats_id_idx;
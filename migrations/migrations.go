@@ -0,0 +1,19 @@
+// Package migrations holds the versioned schema of the Postgres database.
+// The migrations are embedded and applied by `chatctl migrate`.
+package migrations
+
+import (
+	"embed"
+	"github.com/uptrace/bun/migrate"
+)
+
+//go:embed *.sql
+var sqlMigrations embed.FS
+
+var Migrations = migrate.NewMigrations()
+
+func init() {
+	if err := Migrations.Discover(sqlMigrations); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,124 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+	"github.com/uptrace/bun/driver/pgdriver"
+	"github.com/uptrace/bun/migrate"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDB connects to the database of TEST_DSN and empties its public schema.
+// The migrations need Postgres, so the tests are skipped without it.
+func newTestDB(t *testing.T) *bun.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DSN is not set, the database is reset by the test")
+	}
+	db := bun.NewDB(sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn))), pgdialect.New())
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE; CREATE SCHEMA public"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createLegacyChats creates the chats table as it was before the migrations, and saves the chats
+func createLegacyChats(t *testing.T, db *bun.DB, chats [][3]string) {
+	t.Helper()
+	// Without the primary key, as the tables created by hand may have the same message more than once
+	if _, err := db.Exec(`CREATE TABLE chats (
+		message      varchar(255) NOT NULL,
+		is_negative  smallint     NOT NULL DEFAULT 0,
+		source_id    varchar(255) NOT NULL,
+		published_at timestamp    NOT NULL
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chats {
+		if _, err := db.Exec("INSERT INTO chats (message, source_id, published_at) VALUES (?, ?, ?)", c[0], c[1], c[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func migrateUp(t *testing.T, ctx context.Context, db *bun.DB) *migrate.Migrator {
+	t.Helper()
+	migrator := migrate.NewMigrator(db, Migrations)
+	if err := migrator.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return migrator
+}
+
+func TestLegacyChatsGetUniqueIDs(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	createLegacyChats(t, db, [][3]string{
+		{"hello", "video1", "2024-04-01 12:00:00"},
+		{"hello", "video1", "2024-04-01 12:00:00"},
+		{"hello", "video1", "2024-04-01 12:00:01"},
+		{"hello", "video2", "2024-04-01 12:00:00"},
+	})
+	migrateUp(t, ctx, db)
+
+	var ids []string
+	if err := db.NewSelect().Table("chats").Column("id").Scan(ctx, &ids); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if !strings.HasPrefix(id, "legacy:") {
+			t.Errorf("id = %q, want a legacy ID", id)
+		}
+		if seen[id] {
+			t.Errorf("id %q is given to more than one chat", id)
+		}
+		seen[id] = true
+	}
+	if len(ids) != 4 {
+		t.Errorf("chats = %d, want 4", len(ids))
+	}
+}
+
+func TestRollbackKeepsChats(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	createLegacyChats(t, db, [][3]string{
+		{"hello", "video1", "2024-04-01 12:00:00"},
+		{"bye", "video1", "2024-04-01 12:00:01"},
+	})
+	migrator := migrateUp(t, ctx, db)
+	if _, err := migrator.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var publishedAt []time.Time
+	if err := db.NewSelect().Table("chats").Column("published_at").Order("published_at").Scan(ctx, &publishedAt); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	if len(publishedAt) != 2 || !publishedAt[0].Equal(want) {
+		t.Errorf("published_at = %v, want 2 chats from %v", publishedAt, want)
+	}
+
+	var dataType string
+	if err := db.NewSelect().Table("information_schema.columns").Column("data_type").
+		Where("table_schema = 'public' AND table_name = 'chats' AND column_name = 'published_at'").
+		Scan(ctx, &dataType); err != nil {
+		t.Fatal(err)
+	}
+	if dataType != "timestamp without time zone" {
+		t.Errorf("published_at type = %s, want timestamp without time zone", dataType)
+	}
+}
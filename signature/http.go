@@ -0,0 +1,49 @@
+package signature
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// VerifyRequest verifies the signature of the request and returns its body.
+// The body of the request is replaced so that it can be read again.
+// A body larger than MaxBodySize is rejected with *http.MaxBytesError.
+func (v *Verifier) VerifyRequest(r *http.Request) ([]byte, error) {
+	return v.verifyRequest(nil, r)
+}
+
+func (v *Verifier) verifyRequest(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, v.MaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := v.Verify(r.Header, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// Middleware rejects the requests without a valid signature with 401
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := v.verifyRequest(w, r); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if errors.Is(err, ErrMissingHeader) || errors.Is(err, ErrUnknownKey) ||
+				errors.Is(err, ErrExpired) || errors.Is(err, ErrInvalidSignature) {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
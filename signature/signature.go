@@ -0,0 +1,148 @@
+// Package signature signs the requests of the chat function to the external service
+// and verifies them on the receiving side.
+//
+// The signature is the HMAC-SHA256 of the timestamp and the body joined by ".",
+// sent in hex along with the timestamp and the ID of the key:
+//
+//	X-Signature: sha256=<hex>
+//	X-Signature-Timestamp: <unix seconds>
+//	X-Signature-Key-Id: <key ID>
+//
+// For example, the body "hello" at the timestamp 1700000000 signed with the secret "secret" has the signature
+// sha256=47b1df0ab12338b2685470b0d2b37033add7c3b2bc8172f313e77413f1bb78c8,
+// which is the same as the output of `printf 1700000000.hello | openssl dgst -sha256 -hmac secret`.
+//
+// To rotate the key, add the new key to the verifier first, then sign with it, and finally remove the old key.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderSignature = "X-Signature"
+	HeaderTimestamp = "X-Signature-Timestamp"
+	HeaderKeyID     = "X-Signature-Key-Id"
+
+	prefix = "sha256="
+)
+
+var (
+	ErrMissingHeader    = errors.New("signature: missing header")
+	ErrUnknownKey       = errors.New("signature: unknown key")
+	ErrExpired          = errors.New("signature: timestamp out of tolerance")
+	ErrInvalidSignature = errors.New("signature: invalid signature")
+)
+
+// Header is the subset of http.Header used by Signer and Verifier
+type Header interface {
+	Get(key string) string
+	Set(key, value string)
+}
+
+// Sign returns the signature of the body at the timestamp in the form of the X-Signature header
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Key is a secret identified by its ID
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseKeys parses the keys in the form of "id1:secret1,id2:secret2"
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	for _, pair := range strings.Split(s, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("signature: invalid key: %q", pair)
+		}
+		keys = append(keys, Key{ID: id, Secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+// Signer signs the requests with a key
+type Signer struct {
+	Key Key
+	// Now returns the current time, which is time.Now by default
+	Now func() time.Time
+}
+
+func NewSigner(key Key) *Signer {
+	return &Signer{Key: key, Now: time.Now}
+}
+
+// SignHeader sets the headers of the signature of the body
+func (s *Signer) SignHeader(header Header, body []byte) {
+	timestamp := s.Now().Unix()
+	header.Set(HeaderSignature, Sign(s.Key.Secret, timestamp, body))
+	header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	header.Set(HeaderKeyID, s.Key.ID)
+}
+
+// Verifier verifies the signatures made by any of its keys
+type Verifier struct {
+	keys map[string][]byte
+	// Tolerance is the maximum difference between the timestamp and the current time, which limits replays
+	Tolerance time.Duration
+	// MaxBodySize is the maximum size of the body read by VerifyRequest in bytes
+	MaxBodySize int64
+	// Now returns the current time, which is time.Now by default
+	Now func() time.Time
+}
+
+func NewVerifier(keys ...Key) *Verifier {
+	v := &Verifier{
+		keys:        make(map[string][]byte, len(keys)),
+		Tolerance:   5 * time.Minute,
+		MaxBodySize: 1 << 20,
+		Now:         time.Now,
+	}
+	for _, key := range keys {
+		v.keys[key.ID] = key.Secret
+	}
+	return v
+}
+
+// Verify checks the signature headers of the body
+func (v *Verifier) Verify(header Header, body []byte) error {
+	sig := header.Get(HeaderSignature)
+	ts := header.Get(HeaderTimestamp)
+	keyID := header.Get(HeaderKeyID)
+	if sig == "" || ts == "" || keyID == "" {
+		return ErrMissingHeader
+	}
+
+	secret, ok := v.keys[keyID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrExpired, ts)
+	}
+	diff := v.Now().Sub(time.Unix(timestamp, 0))
+	if diff < -v.Tolerance || diff > v.Tolerance {
+		return fmt.Errorf("%w: %s", ErrExpired, ts)
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
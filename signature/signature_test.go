@@ -0,0 +1,139 @@
+package signature
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignKnownVector(t *testing.T) {
+	// printf 1700000000.hello | openssl dgst -sha256 -hmac secret
+	want := "sha256=47b1df0ab12338b2685470b0d2b37033add7c3b2bc8172f313e77413f1bb78c8"
+	if got := Sign([]byte("secret"), 1700000000, []byte("hello")); got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte("hello")
+	key := Key{ID: "k1", Secret: []byte("secret")}
+
+	tests := []struct {
+		name    string
+		keys    []Key
+		skew    time.Duration
+		keyID   string
+		body    []byte
+		wantErr error
+	}{
+		{name: "valid", keys: []Key{key}, keyID: "k1", body: body},
+		{name: "at the tolerance in the past", keys: []Key{key}, skew: -5 * time.Minute, keyID: "k1", body: body},
+		{name: "at the tolerance in the future", keys: []Key{key}, skew: 5 * time.Minute, keyID: "k1", body: body},
+		{name: "too old", keys: []Key{key}, skew: -5*time.Minute - time.Second, keyID: "k1", body: body, wantErr: ErrExpired},
+		{name: "too new", keys: []Key{key}, skew: 5*time.Minute + time.Second, keyID: "k1", body: body, wantErr: ErrExpired},
+		{name: "unknown key", keys: []Key{key}, keyID: "k2", body: body, wantErr: ErrUnknownKey},
+		{name: "tampered body", keys: []Key{key}, keyID: "k1", body: []byte("hello!"), wantErr: ErrInvalidSignature},
+		{name: "missing key ID", keys: []Key{key}, keyID: "", body: body, wantErr: ErrMissingHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := NewSigner(key)
+			signer.Now = func() time.Time { return now.Add(tt.skew) }
+			header := http.Header{}
+			signer.SignHeader(header, body)
+			if tt.keyID != key.ID {
+				header.Set(HeaderKeyID, tt.keyID)
+			}
+
+			v := NewVerifier(tt.keys...)
+			v.Now = func() time.Time { return now }
+			err := v.Verify(header, tt.body)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte("hello")
+	oldKey := Key{ID: "old", Secret: []byte("old-secret")}
+	newKey := Key{ID: "new", Secret: []byte("new-secret")}
+
+	sign := func(key Key) http.Header {
+		signer := NewSigner(key)
+		signer.Now = func() time.Time { return now }
+		header := http.Header{}
+		signer.SignHeader(header, body)
+		return header
+	}
+	verify := func(header http.Header, keys ...Key) error {
+		v := NewVerifier(keys...)
+		v.Now = func() time.Time { return now }
+		return v.Verify(header, body)
+	}
+
+	// While both keys are accepted, the senders can switch to the new key at any time
+	if err := verify(sign(oldKey), oldKey, newKey); err != nil {
+		t.Errorf("old key during rotation: %v", err)
+	}
+	if err := verify(sign(newKey), oldKey, newKey); err != nil {
+		t.Errorf("new key during rotation: %v", err)
+	}
+	// After the old key is removed, only the new key is accepted
+	if err := verify(sign(oldKey), newKey); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("old key after rotation = %v, want %v", err, ErrUnknownKey)
+	}
+	// The signature of a key is not accepted under the ID of another key
+	header := sign(oldKey)
+	header.Set(HeaderKeyID, newKey.ID)
+	if err := verify(header, oldKey, newKey); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("swapped key ID = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	key := Key{ID: "k1", Secret: []byte("secret")}
+	v := NewVerifier(key)
+	v.Now = func() time.Time { return now }
+	v.MaxBodySize = 8
+
+	handler := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body can be read again after the verification
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+
+	request := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(HeaderSignature, Sign(key.Secret, now.Unix(), []byte(body)))
+		req.Header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set(HeaderKeyID, key.ID)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("hello"); rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Errorf("valid request = %d %q, want 200 hello", rec.Code, rec.Body)
+	}
+	if rec := request("too long body"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large request = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("hello")))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,182 @@
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"time"
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string        { return "msgpack" }
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Marshal(env Envelope) ([]byte, error) {
+	return msgpack.Marshal(env)
+}
+
+func (msgpackCodec) Unmarshal(b []byte, env *Envelope) error {
+	return msgpack.Unmarshal(b, env)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string        { return "json" }
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Marshal(env Envelope) ([]byte, error) {
+	return json.Marshal(env)
+}
+
+func (jsonCodec) Unmarshal(b []byte, env *Envelope) error {
+	return json.Unmarshal(b, env)
+}
+
+// protobufCodec encodes envelope.proto by hand with protowire, so no code is generated
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string        { return "protobuf" }
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) Marshal(env Envelope) ([]byte, error) {
+	var b []byte
+	if env.SchemaVersion != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(env.SchemaVersion))
+	}
+	b = appendString(b, 2, env.VideoID)
+	b = appendString(b, 3, env.BatchID)
+	if !env.SentAt.IsZero() {
+		// google.protobuf.Timestamp
+		var ts []byte
+		ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(env.SentAt.Unix()))
+		if nanos := env.SentAt.Nanosecond(); nanos != 0 {
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(nanos))
+		}
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	for _, item := range env.Items {
+		var ib []byte
+		ib = appendString(ib, 1, item.ID)
+		ib = appendString(ib, 2, item.AuthorChannelID)
+		ib = appendString(ib, 3, item.Message)
+		ib = appendString(ib, 4, item.MessageType)
+		if item.PublishedAtUnix != 0 {
+			ib = protowire.AppendTag(ib, 5, protowire.VarintType)
+			ib = protowire.AppendVarint(ib, uint64(item.PublishedAtUnix))
+		}
+		ib = appendString(ib, 6, item.AuthorClass)
+		if item.IsNegative {
+			ib = protowire.AppendTag(ib, 7, protowire.VarintType)
+			ib = protowire.AppendVarint(ib, 1)
+		}
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, ib)
+	}
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(b []byte, env *Envelope) error {
+	*env = Envelope{}
+	return ConsumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			n, _ := protowire.ConsumeVarint(v)
+			env.SchemaVersion = int(n)
+		case num == 2 && typ == protowire.BytesType:
+			env.VideoID = string(v)
+		case num == 3 && typ == protowire.BytesType:
+			env.BatchID = string(v)
+		case num == 4 && typ == protowire.BytesType:
+			var sec, nsec uint64
+			err := ConsumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if typ != protowire.VarintType {
+					return nil
+				}
+				switch num {
+				case 1:
+					sec, _ = protowire.ConsumeVarint(v)
+				case 2:
+					nsec, _ = protowire.ConsumeVarint(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			env.SentAt = time.Unix(int64(sec), int64(nsec)).UTC()
+		case num == 5 && typ == protowire.BytesType:
+			var item Item
+			err := ConsumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					item.ID = string(v)
+				case num == 2 && typ == protowire.BytesType:
+					item.AuthorChannelID = string(v)
+				case num == 3 && typ == protowire.BytesType:
+					item.Message = string(v)
+				case num == 4 && typ == protowire.BytesType:
+					item.MessageType = string(v)
+				case num == 5 && typ == protowire.VarintType:
+					n, _ := protowire.ConsumeVarint(v)
+					item.PublishedAtUnix = int64(n)
+				case num == 6 && typ == protowire.BytesType:
+					item.AuthorClass = string(v)
+				case num == 7 && typ == protowire.VarintType:
+					n, _ := protowire.ConsumeVarint(v)
+					item.IsNegative = n != 0
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			env.Items = append(env.Items, item)
+		}
+		return nil
+	})
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// ConsumeFields calls fn for each field of the protobuf message b, and stops at the first error.
+// v is the content of the field for the bytes type, and the raw value for the other types.
+func ConsumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("wire: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v []byte
+		if typ == protowire.BytesType {
+			v, n = protowire.ConsumeBytes(b)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		}
+		if n < 0 {
+			return fmt.Errorf("wire: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
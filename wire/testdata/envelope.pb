@@ -0,0 +1,4 @@
+video$9a2f6d3e-1b7c-4f0e-8d5a-2c3b4e5f6a7b"	ê*F
+chat-1	channel-1こんにちは"textMessageEvent(ê2target8*<
+chat-2	channel-2
+super chat"superChatEvent(ê2other
\ No newline at end of file
@@ -0,0 +1,79 @@
+// Package wire is the schema of the batches of chats sent to the external service.
+//
+// A batch is an Envelope encoded by one of the codecs, which is told by the Content-Type header:
+// application/msgpack (default), application/json or application/x-protobuf.
+// The keys of MessagePack and JSON and the field numbers of Protobuf (envelope.proto) never change
+// within a schema version. A field is only added with a new key or number,
+// and SchemaVersion is incremented when the meaning of an existing field changes.
+package wire
+
+import (
+	"fmt"
+	"mime"
+	"time"
+)
+
+// SchemaVersion is the version of the schema written by this package
+const SchemaVersion = 1
+
+type Envelope struct {
+	SchemaVersion int `json:"schemaVersion" msgpack:"schemaVersion"`
+	// VideoID is the source ID of the video of the chats
+	VideoID string `json:"videoId" msgpack:"videoId"`
+	// BatchID is the same as the Idempotency-Key header
+	BatchID string    `json:"batchId" msgpack:"batchId"`
+	SentAt  time.Time `json:"sentAt" msgpack:"sentAt"`
+	Items   []Item    `json:"items" msgpack:"items"`
+}
+
+type Item struct {
+	ID              string `json:"id" msgpack:"id"`
+	AuthorChannelID string `json:"authorChannelId" msgpack:"authorChannelId"`
+	Message         string `json:"message" msgpack:"message"`
+	MessageType     string `json:"messageType" msgpack:"messageType"`
+	PublishedAtUnix int64  `json:"publishedAtUnix" msgpack:"publishedAtUnix"`
+	// AuthorClass is "target" for the chats by the target channels and "other" for the others
+	AuthorClass string `json:"authorClass" msgpack:"authorClass"`
+	// IsNegative is analyzed only for the target chats outside the lives
+	IsNegative bool `json:"isNegative" msgpack:"isNegative"`
+}
+
+// Codec encodes and decodes the envelopes
+type Codec interface {
+	// Name is the name of the codec in the configuration
+	Name() string
+	ContentType() string
+	Marshal(env Envelope) ([]byte, error)
+	Unmarshal(b []byte, env *Envelope) error
+}
+
+var (
+	Msgpack  Codec = msgpackCodec{}
+	JSON     Codec = jsonCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+// CodecByName returns the codec named "msgpack", "json" or "protobuf"
+func CodecByName(name string) (Codec, error) {
+	for _, codec := range []Codec{Msgpack, JSON, Protobuf} {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("wire: unknown codec: %s", name)
+}
+
+// CodecByContentType returns the codec of the Content-Type header for the receiver.
+// The parameters such as charset are ignored.
+func CodecByContentType(contentType string) (Codec, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("wire: invalid content type: %s: %w", contentType, err)
+	}
+	for _, codec := range []Codec{Msgpack, JSON, Protobuf} {
+		if codec.ContentType() == mediaType {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("wire: unknown content type: %s", contentType)
+}
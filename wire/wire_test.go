@@ -0,0 +1,111 @@
+package wire
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenEnvelope is the envelope of the golden files, which covers every field
+var goldenEnvelope = Envelope{
+	SchemaVersion: SchemaVersion,
+	VideoID:       "video",
+	BatchID:       "9a2f6d3e-1b7c-4f0e-8d5a-2c3b4e5f6a7b",
+	SentAt:        time.Date(2024, 4, 1, 12, 0, 0, 500, time.UTC),
+	Items: []Item{
+		{
+			ID:              "chat-1",
+			AuthorChannelID: "channel-1",
+			Message:         "こんにちは",
+			MessageType:     "textMessageEvent",
+			PublishedAtUnix: 1711972800,
+			AuthorClass:     "target",
+			IsNegative:      true,
+		},
+		{
+			ID:              "chat-2",
+			AuthorChannelID: "channel-2",
+			Message:         "super chat",
+			MessageType:     "superChatEvent",
+			PublishedAtUnix: 1711972801,
+			AuthorClass:     "other",
+		},
+	},
+}
+
+// TestCodecGolden fails when the encoding of a codec changes, which breaks the receivers of the schema version
+func TestCodecGolden(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		file  string
+	}{
+		{codec: Msgpack, file: "envelope.msgpack"},
+		{codec: JSON, file: "envelope.json"},
+		{codec: Protobuf, file: "envelope.pb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec.Name(), func(t *testing.T) {
+			path := filepath.Join("testdata", tt.file)
+			got, err := tt.codec.Marshal(goldenEnvelope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Marshal = %q, want %q", got, want)
+			}
+
+			var env Envelope
+			if err := tt.codec.Unmarshal(want, &env); err != nil {
+				t.Fatal(err)
+			}
+			if !env.SentAt.Equal(goldenEnvelope.SentAt) {
+				t.Errorf("SentAt = %v, want %v", env.SentAt, goldenEnvelope.SentAt)
+			}
+			env.SentAt = goldenEnvelope.SentAt
+			if !reflect.DeepEqual(env, goldenEnvelope) {
+				t.Errorf("Unmarshal = %+v, want %+v", env, goldenEnvelope)
+			}
+		})
+	}
+}
+
+func TestCodecByContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        Codec
+	}{
+		{contentType: "application/msgpack", want: Msgpack},
+		{contentType: "application/json", want: JSON},
+		{contentType: "application/json; charset=utf-8", want: JSON},
+		{contentType: "Application/X-Protobuf", want: Protobuf},
+		{contentType: "text/plain"},
+		{contentType: ""},
+	}
+	for _, tt := range tests {
+		got, err := CodecByContentType(tt.contentType)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("CodecByContentType(%q) = %s, want an error", tt.contentType, got.Name())
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("CodecByContentType(%q) = %v, %v, want %s", tt.contentType, got, err, tt.want.Name())
+		}
+	}
+}